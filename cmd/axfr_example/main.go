@@ -6,7 +6,7 @@ import (
 )
 
 func main() {
-	res, _, err := awesomedns.Resolve(awesomedns.RR_AXFR, "zonetransfer.me", awesomedns.Config{"81.4.108.41:53", true})
+	res, _, err := awesomedns.Resolve(awesomedns.RR_AXFR, "zonetransfer.me", awesomedns.Config{Server: "81.4.108.41:53", IsTCP: true})
 	if err != nil {
 		log.Print("err", err)
 	}
@@ -11,7 +11,7 @@ func main() {
 	for i := 0; i < 100; i++ {
 		q = append(q, strconv.Itoa(i)+".ya.ru")
 	}
-	res, err := awesomedns.MegaBulkResolveA(q, awesomedns.Config{"77.88.8.8:53"})
+	res, err := awesomedns.MegaBulkResolveA(q, awesomedns.Config{Server: "77.88.8.8:53"})
 	if err != nil {
 		log.Print("err", err)
 	}
@@ -11,7 +11,11 @@ func main() {
 	for i := 0; i < 100; i++ {
 		q = append(q, strconv.Itoa(i)+".ya.ru")
 	}
-	res, err := awesomedns.BulkResolveA(q, awesomedns.Config{"77.88.8.8:53", false})
+	config, err := awesomedns.ConfigFromResolvConf("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := awesomedns.BulkResolveA(q, config)
 	if err != nil {
 		log.Print("err", err)
 	}
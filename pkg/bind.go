@@ -0,0 +1,47 @@
+package awesomedns
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// dialer учитывает LocalAddr и BindDevice из config. network - udp или tcp
+func (config Config) dialer(network string) (*net.Dialer, error) {
+	dialer := &net.Dialer{}
+	if config.LocalAddr != "" {
+		host, port := config.LocalAddr, 0
+		if h, p, err := net.SplitHostPort(config.LocalAddr); err == nil {
+			host = h
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, err
+			}
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, &net.AddrError{Err: "invalid local address", Addr: config.LocalAddr}
+		}
+		if network == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	if config.BindDevice != "" {
+		control, err := bindToDevice(config.BindDevice)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+	}
+	return dialer, nil
+}
+
+// dialTCP tcp соединение с адресом и интерфейсом из config
+func (config Config) dialTCP(ctx context.Context, server string) (net.Conn, error) {
+	dialer, err := config.dialer("tcp")
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, "tcp", server)
+}
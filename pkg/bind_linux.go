@@ -0,0 +1,17 @@
+package awesomedns
+
+import "syscall"
+
+// bindToDevice привязывает сокет к интерфейсу через SO_BINDTODEVICE. нужны права CAP_NET_RAW
+func bindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}, nil
+}
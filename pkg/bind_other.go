@@ -0,0 +1,12 @@
+//go:build !linux
+
+package awesomedns
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to device is supported only on linux")
+}
@@ -0,0 +1,181 @@
+package awesomedns
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestConfigDialer(t *testing.T) {
+	tests := []struct {
+		localAddr string
+		network   string
+		want      net.Addr
+		ok        bool
+	}{
+		{"", "udp", nil, true},
+		{"192.0.2.1", "udp", &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{"192.0.2.1:5353", "udp", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, true},
+		{"[2001:db8::1]:5353", "tcp", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, true},
+		{"2001:db8::1", "tcp", &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{"host.example", "udp", nil, false},
+		{"192.0.2.1:port", "udp", nil, false},
+	}
+	for _, tt := range tests {
+		dialer, err := Config{LocalAddr: tt.localAddr}.dialer(tt.network)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v", tt.localAddr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tt.want == nil && dialer.LocalAddr != nil || tt.want != nil && (dialer.LocalAddr == nil || dialer.LocalAddr.String() != tt.want.String()) {
+			t.Errorf("%q %v: LocalAddr = %v, want %v", tt.localAddr, tt.network, dialer.LocalAddr, tt.want)
+		}
+	}
+}
+
+// freePort свободный порт на 127.0.0.1 для network
+func freePort(t *testing.T, network string) int {
+	t.Helper()
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		return pc.LocalAddr().(*net.UDPAddr).Port
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// запросы уходят с LocalAddr по udp, tcp, через пул и по DoT
+func TestLocalAddr(t *testing.T) {
+	cert, x509Cert := selfSigned(t)
+	dot, err := NewDoT(DoTConfig{SPKIPins: []string{SPKIPin(x509Cert)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	pool := NewTCPPool()
+	defer pool.Close()
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"udp", Config{}},
+		{"tcp", Config{IsTCP: true}},
+		{"tcp pool", Config{IsTCP: true, TCPPool: pool}},
+		{"DoT", Config{TLS: dot}},
+	}
+	for _, tt := range tests {
+		from := make(chan net.Addr, 1)
+		handler := func(q []byte) []byte {
+			return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+		}
+		config := tt.config
+		network := "tcp"
+		switch {
+		case config.TLS != nil:
+			config.Server = localAddrDoTServer(t, cert, from)
+		case config.IsTCP:
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			serveTCP(t, acceptNotifier{l, from}, handler)
+			config.Server = l.Addr().String()
+		default:
+			network = "udp"
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			serveUDP(t, notifyingPacketConn{pc, from}, handler)
+			config.Server = pc.LocalAddr().String()
+		}
+		port := freePort(t, network)
+		config.LocalAddr = "127.0.0.1:" + strconv.Itoa(port)
+		if _, err := ResolveA("example.com", config); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		got := <-from
+		if host, p, _ := net.SplitHostPort(got.String()); host != "127.0.0.1" || p != strconv.Itoa(port) {
+			t.Errorf("%v: query from %v, want port %v", tt.name, got, port)
+		}
+	}
+}
+
+// acceptNotifier сообщает адрес каждого принятого соединения
+type acceptNotifier struct {
+	net.Listener
+	from chan net.Addr
+}
+
+func (l acceptNotifier) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		select {
+		case l.from <- conn.RemoteAddr():
+		default:
+		}
+	}
+	return conn, err
+}
+
+// notifyingPacketConn сообщает адрес отправителя каждой датаграммы
+type notifyingPacketConn struct {
+	net.PacketConn
+	from chan net.Addr
+}
+
+func (pc notifyingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(b)
+	if err == nil {
+		select {
+		case pc.from <- addr:
+		default:
+		}
+	}
+	return n, addr, err
+}
+
+func localAddrDoTServer(t *testing.T, cert tls.Certificate, from chan net.Addr) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, acceptNotifier{l, from}, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	})
+	return l.Addr().String()
+}
+
+func TestBindDevice(t *testing.T) {
+	server := udpServer(t, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	})
+	_, err := ResolveA("example.com", Config{Server: server, BindDevice: "lo"})
+	switch {
+	case runtime.GOOS != "linux":
+		if err == nil {
+			t.Error("BindDevice accepted on " + runtime.GOOS)
+		}
+	case errors.Is(err, syscall.EPERM):
+		t.Skip("SO_BINDTODEVICE needs CAP_NET_RAW")
+	case err != nil:
+		t.Error(err)
+	}
+}
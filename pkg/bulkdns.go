@@ -4,7 +4,6 @@ package awesomedns
 // вывываем Resolve на каждый запрос
 // нет перепосылки
 import (
-	"log"
 	"net"
 )
 
@@ -51,9 +50,9 @@ func BulkResolveA(req []string, config Config) (map[string]Answer, error) {
 	for i := 0; i < len(req); i++ {
 		a := <-ans
 		res[a.query] = Answer{a.answer, a.err}
-		log.Printf("recv %v", a)
+		config.logger().Debug("recv", "qname", a.query, "ips", a.answer, "err", a.err)
 	}
-	log.Println("done", res)
+	config.logger().Debug("done", "queries", len(res))
 
 	return res, nil
 }
@@ -0,0 +1,269 @@
+package awesomedns
+
+// кэш ответов с учетом ttl. NXDOMAIN и ответы без данных кэшируются по rfc2308
+// на min(ttl SOA, SOA minimum) из authority, без SOA не кэшируются.
+// при переполнении вытесняются давно не использованные записи.
+// популярные записи обновляются в фоне до истечения ttl, устаревшие могут
+// отдаваться при отказе всех серверов (rfc8767)
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheEntries = 10000
+	maxCacheTtl         = 24 * time.Hour
+	maxNegativeCacheTtl = 3 * time.Hour // rfc2308 5
+	prefetchRemaining   = 10            // обновлять, когда осталось меньше стольких процентов ttl
+)
+
+// значения, рекомендованные rfc8767
+const (
+	// ttl устаревших записей в ответе (rfc8767 4), чтобы клиенты не держали их долго
+	rfc8767StaleAnswerTtl = 30
+	// failure recheck timer (rfc8767 5): столько после отказа серверов устаревшая
+	// запись отдается сразу, без новых запросов к ним
+	rfc8767FailureRecheck = 30 * time.Second
+)
+
+// Cache кэш для Config.Cache. безопасен для одновременного использования,
+// один кэш можно передать в несколько Config
+type Cache struct {
+	// максимальное число записей, по умолчанию 10000
+	MaxEntries int
+	// сколько хранить записи после истечения ttl, чтобы отдавать их, когда все
+	// серверы отказали. 0 - не отдавать. rfc8767 советует от 1 до 3 суток
+	StaleTtl time.Duration
+	// после стольких обращений запись обновляется в фоне, когда остается 10% ttl.
+	// 0 - не обновлять
+	PrefetchHits int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// cacheKey имя в нижнем регистре и тип. запросы бывают только класса IN
+type cacheKey struct {
+	name   string
+	rrtype DnsType
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	records []DnsRecord
+	err     error // errNameError для NXDOMAIN, nil для ответа с данными или без них
+	stored  time.Time
+	expire  time.Time
+
+	hits        int
+	prefetching bool
+	failed      time.Time // когда последний раз отдана устаревшая запись
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{MaxEntries: maxEntries}
+}
+
+// Len число записей, включая устаревшие, но еще не вытесненные
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Flush удаляет все записи
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru = nil
+}
+
+// get записи с ttl, уменьшенным на время хранения. nil кэш всегда пуст.
+// refresh вызывается, когда популярную запись пора обновить
+func (c *Cache) get(qname string, rrtype DnsType, refresh func()) ([]DnsRecord, bool, error) {
+	if c == nil {
+		return nil, false, nil
+	}
+	key, ok := newCacheKey(qname, rrtype)
+	if !ok {
+		return nil, false, nil
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expire) {
+		switch {
+		case !now.Before(entry.expire.Add(c.StaleTtl)):
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		case now.Sub(entry.failed) < rfc8767FailureRecheck:
+			// серверы недавно отказали, не ждем их снова (rfc8767 5)
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.staleRecords(), true, entry.err
+		}
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	prefetch := refresh != nil && c.PrefetchHits > 0 && entry.hits >= c.PrefetchHits && !entry.prefetching &&
+		entry.expire.Sub(now) < entry.expire.Sub(entry.stored)*prefetchRemaining/100
+	if prefetch {
+		entry.prefetching = true
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	records := make([]DnsRecord, len(entry.records))
+	for i, rr := range entry.records {
+		rr.Ttl -= min(rr.Ttl, elapsed)
+		records[i] = rr
+	}
+	c.mu.Unlock()
+	if prefetch {
+		refresh()
+	}
+	return records, true, entry.err
+}
+
+// prefetchFailed разрешает снова обновить запись после неудачного обновления
+func (c *Cache) prefetchFailed(qname string, rrtype DnsType) {
+	if c == nil {
+		return
+	}
+	key, ok := newCacheKey(qname, rrtype)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// stale устаревшая запись в пределах StaleTtl, когда получить свежую не удалось
+func (c *Cache) stale(qname string, rrtype DnsType) ([]DnsRecord, bool, error) {
+	if c == nil || c.StaleTtl <= 0 {
+		return nil, false, nil
+	}
+	key, ok := newCacheKey(qname, rrtype)
+	if !ok {
+		return nil, false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expire.Add(c.StaleTtl)) {
+		return nil, false, nil
+	}
+	entry.failed = now
+	return entry.staleRecords(), true, entry.err
+}
+
+func (entry *cacheEntry) staleRecords() []DnsRecord {
+	records := make([]DnsRecord, len(entry.records))
+	for i, rr := range entry.records {
+		rr.Ttl = rfc8767StaleAnswerTtl
+		records[i] = rr
+	}
+	return records
+}
+
+// store кэширует разобранный ответ. err - результат разбора, кэшируются только
+// ответы с данными, без данных и NXDOMAIN
+func (c *Cache) store(qname string, rrtype DnsType, response []byte, records []DnsRecord, err error) {
+	if c == nil || (err != nil && !errors.Is(err, errNameError)) {
+		return
+	}
+	key, ok := newCacheKey(qname, rrtype)
+	if !ok {
+		return
+	}
+	var ttl time.Duration
+	if err == nil && len(records) > 0 {
+		ttl = maxCacheTtl
+		for _, rr := range records {
+			ttl = min(ttl, time.Duration(rr.Ttl)*time.Second)
+		}
+	} else if ttl, ok = negativeTtl(response); !ok {
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{key: key, records: records, err: err, stored: now, expire: now.Add(ttl)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[cacheKey]*list.Element{}
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[key]; ok {
+		// популярность сохраняется при обновлении
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	for c.lru.Len() > maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// storeResponse кэширует ответ, который еще не разобран
+func (c *Cache) storeResponse(qname string, rrtype DnsType, response []byte) {
+	if c == nil {
+		return
+	}
+	records, _, err := parseDnsRecords(response, false)
+	c.store(qname, rrtype, response, records, err)
+}
+
+// negativeTtl срок хранения ответа без данных по SOA из authority
+func negativeTtl(response []byte) (time.Duration, bool) {
+	msg, err := ParseMessage(response)
+	if err != nil {
+		return 0, false
+	}
+	for _, rr := range msg.Authority {
+		if soa, ok := rr.Data.(DnsSoa); ok {
+			ttl := time.Duration(min(rr.Ttl, soa.Minimum)) * time.Second
+			return min(ttl, maxNegativeCacheTtl), true
+		}
+	}
+	return 0, false
+}
+
+func newCacheKey(qname string, rrtype DnsType) (cacheKey, bool) {
+	qname, err := ToASCII(qname)
+	if err != nil {
+		return cacheKey{}, false
+	}
+	name, err := ParseName(qname)
+	if err != nil {
+		return cacheKey{}, false
+	}
+	return cacheKey{name.Lower().String(), rrtype}, true
+}
@@ -0,0 +1,344 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ageCache сдвигает время сохранения записи в прошлое на d
+func ageCache(t *testing.T, c *Cache, qname string, rrtype DnsType, d time.Duration) {
+	t.Helper()
+	key, _ := newCacheKey(qname, rrtype)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		t.Fatalf("%v %v not in cache", qname, RRnames[rrtype])
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-d)
+	entry.expire = entry.expire.Add(-d)
+}
+
+func TestCacheTtl(t *testing.T) {
+	tests := []struct {
+		age     time.Duration
+		ttl     []uint32
+		queries int
+	}{
+		{0, []uint32{60, 300}, 1},
+		{20 * time.Second, []uint32{40, 280}, 1},
+		{59 * time.Second, []uint32{1, 241}, 1},
+		// запись живет по наименьшему ttl
+		{60 * time.Second, []uint32{60, 300}, 2},
+	}
+	for _, tt := range tests {
+		transport, queries := fakeTransport(t, 0, testRR{"", RR_A, 60, "192.0.2.1"}, testRR{"", RR_A, 300, "192.0.2.2"})
+		config := Config{Transport: transport, Cache: NewCache(10)}
+		ctx := context.Background()
+		if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+			t.Fatal(err)
+		}
+		ageCache(t, config.Cache, "example.com", RR_A, tt.age)
+		records, _, err := resolve(ctx, RR_A, "Example.COM.", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ttl []uint32
+		for _, rr := range records {
+			ttl = append(ttl, rr.Ttl)
+		}
+		if !reflect.DeepEqual(ttl, tt.ttl) || len(queries()) != tt.queries {
+			t.Errorf("after %v: ttl %v, queries %v, want %v, %v", tt.age, ttl, queries(), tt.ttl, tt.queries)
+		}
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcode  byte
+		soaTtl uint32 // 0 - без SOA
+		err    error
+		ttl    time.Duration // 0 - не кэшируется
+	}{
+		{"NXDOMAIN by SOA minimum", 3, 300, errNameError, 60 * time.Second},
+		{"NXDOMAIN by SOA ttl", 3, 30, errNameError, 30 * time.Second},
+		{"NODATA", 0, 300, nil, 60 * time.Second},
+		{"NXDOMAIN without SOA", 3, 0, errNameError, 0},
+		{"NODATA without SOA", 0, 0, nil, 0},
+	}
+	for _, tt := range tests {
+		var queries atomic.Int32
+		transport := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			queries.Add(1)
+			var authority []testRR
+			if tt.soaTtl > 0 {
+				authority = append(authority, testRR{"example.com", RR_SOA, tt.soaTtl, ""})
+			}
+			return testResponse(t, q, tt.rcode, nil, authority), nil
+		})
+		config := Config{Transport: transport, Cache: NewCache(10)}
+		for i := 0; i < 2; i++ {
+			if ips, err := ResolveA("nx.example.com", config); !errors.Is(err, tt.err) || len(ips) != 0 {
+				t.Errorf("%v: ResolveA = %v, %v", tt.name, ips, err)
+			}
+		}
+		if tt.ttl == 0 {
+			if queries.Load() != 2 || config.Cache.Len() != 0 {
+				t.Errorf("%v: cached, queries %v", tt.name, queries.Load())
+			}
+			continue
+		}
+		ageCache(t, config.Cache, "nx.example.com", RR_A, tt.ttl-time.Second)
+		ResolveA("nx.example.com", config)
+		if queries.Load() != 1 {
+			t.Errorf("%v: expired before %v", tt.name, tt.ttl)
+		}
+		ageCache(t, config.Cache, "nx.example.com", RR_A, time.Second)
+		ResolveA("nx.example.com", config)
+		if queries.Load() != 2 {
+			t.Errorf("%v: not expired after %v", tt.name, tt.ttl)
+		}
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	transport, queries := fakeTransport(t, 0, testRR{"", RR_A, 300, "192.0.2.1"})
+	config := Config{Transport: transport, Cache: NewCache(2)}
+	for _, name := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		if _, err := ResolveA(name, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// c вытесняет b, к которому обращались раньше a
+	want := []string{"a.example", "b.example", "c.example", "b.example"}
+	if q := queries(); !reflect.DeepEqual(q, want) || config.Cache.Len() != 2 {
+		t.Errorf("queries %v, want %v, len %v", q, want, config.Cache.Len())
+	}
+}
+
+func TestCacheUnicodeNames(t *testing.T) {
+	transport, queries := fakeTransport(t, 0, testRR{"", RR_CNAME, 300, "xn--e1afmkfd.xn--p1ai"})
+	config := Config{Transport: transport, Cache: NewCache(10), UnicodeNames: true}
+	for i := 0; i < 2; i++ {
+		res, err := ResolveCname("a.example", config)
+		if err != nil || !reflect.DeepEqual(res, []string{"пример.рф"}) {
+			t.Errorf("ResolveCname = %v, %v", res, err)
+		}
+	}
+	// в кэше имена остаются в ascii
+	records, ok, _ := config.Cache.get("a.example", RR_CNAME, nil)
+	if !ok || records[0].Data != "xn--e1afmkfd.xn--p1ai" || len(queries()) != 1 {
+		t.Errorf("cached %v, queries %v", records, queries())
+	}
+}
+
+// кэш общий для Resolver и MegaBulkResolveA с тем же Config
+func TestCacheShared(t *testing.T) {
+	var count atomic.Int32
+	server := udpServer(t, func(q []byte) []byte {
+		count.Add(1)
+		return answerByName(t)(q)
+	})
+	config := Config{Server: server, Cache: NewCache(10)}
+	if _, err := ResolveA("a.example", config); err != nil {
+		t.Fatal(err)
+	}
+	res, err := MegaBulkResolveA([]string{"a.example", "b.example"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.example", "b.example"} {
+		if answer := res[name]; answer.Err != nil || len(answer.Ips) != 1 || answer.Ips[0].String() != poolTestAddrs[name] {
+			t.Errorf("MegaBulkResolveA %v: %+v", name, answer)
+		}
+	}
+	if ips, err := ResolveA("b.example", config); err != nil || len(ips) != 1 {
+		t.Errorf("ResolveA = %v, %v", ips, err)
+	}
+	if n := count.Load(); n != 2 {
+		t.Errorf("%v queries, want 2", n)
+	}
+}
+
+// switchTransport отвечает записью с ttl 60 или SERVFAIL, пока failing
+func switchTransport(t *testing.T) (Transport, *atomic.Bool, *atomic.Int32) {
+	var failing atomic.Bool
+	var queries atomic.Int32
+	transport := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		queries.Add(1)
+		if failing.Load() {
+			return testResponse(t, q, 2, nil, nil), nil
+		}
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil), nil
+	})
+	return transport, &failing, &queries
+}
+
+func TestCacheServeStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		staleTtl time.Duration
+		age      time.Duration // сколько прошло после истечения ttl
+		stale    bool
+	}{
+		{"serve stale", time.Hour, time.Second, true},
+		{"end of stale window", time.Hour, time.Hour - time.Second, true},
+		{"past stale window", time.Hour, time.Hour, false},
+		{"disabled", 0, time.Second, false},
+	}
+	for _, tt := range tests {
+		transport, failing, queries := switchTransport(t)
+		cache := NewCache(10)
+		cache.StaleTtl = tt.staleTtl
+		config := Config{Transport: transport, Cache: cache}
+		ctx := context.Background()
+		if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+			t.Fatal(err)
+		}
+		ageCache(t, cache, "example.com", RR_A, 60*time.Second+tt.age)
+		failing.Store(true)
+		records, _, err := resolve(ctx, RR_A, "example.com", config)
+		if !tt.stale {
+			if !errors.Is(err, errServFail) || len(records) != 0 {
+				t.Errorf("%v: %v, %v, want SERVFAIL", tt.name, records, err)
+			}
+			continue
+		}
+		if err != nil || len(records) != 1 || records[0].Ttl != rfc8767StaleAnswerTtl {
+			t.Errorf("%v: %v, %v", tt.name, records, err)
+		}
+		// после отказа серверы не спрашиваются в течение failure recheck timer
+		n := queries.Load()
+		if records, _, err := resolve(ctx, RR_A, "example.com", config); err != nil || len(records) != 1 || queries.Load() != n {
+			t.Errorf("%v: recheck %v, %v, queries %v -> %v", tt.name, records, err, n, queries.Load())
+		}
+		cache.mu.Lock()
+		for _, elem := range cache.entries {
+			elem.Value.(*cacheEntry).failed = time.Now().Add(-rfc8767FailureRecheck)
+		}
+		cache.mu.Unlock()
+		failing.Store(false)
+		records, _, err = resolve(ctx, RR_A, "example.com", config)
+		if err != nil || len(records) != 1 || records[0].Ttl != 60 || queries.Load() != n+1 {
+			t.Errorf("%v: after recheck %v, %v, queries %v", tt.name, records, err, queries.Load())
+		}
+	}
+}
+
+// значения из рекомендаций rfc8767 4 и 5
+func TestRfc8767Constants(t *testing.T) {
+	if rfc8767StaleAnswerTtl != 30 || rfc8767FailureRecheck != 30*time.Second {
+		t.Errorf("stale answer ttl %v, failure recheck %v", rfc8767StaleAnswerTtl, rfc8767FailureRecheck)
+	}
+}
+
+// NXDOMAIN - ответ, а не отказ, устаревшая запись его не заменяет
+func TestCacheStaleNotForNameError(t *testing.T) {
+	var nx atomic.Bool
+	transport := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		if nx.Load() {
+			return testResponse(t, q, 3, nil, nil), nil
+		}
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil), nil
+	})
+	cache := NewCache(10)
+	cache.StaleTtl = time.Hour
+	config := Config{Transport: transport, Cache: cache}
+	if _, err := ResolveA("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	ageCache(t, cache, "example.com", RR_A, 61*time.Second)
+	nx.Store(true)
+	if ips, err := ResolveA("example.com", config); !errors.Is(err, errNameError) {
+		t.Errorf("ResolveA = %v, %v", ips, err)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		hits     int // Cache.PrefetchHits
+		gets     int
+		age      time.Duration
+		prefetch bool
+	}{
+		{"popular near expiry", 2, 2, 55 * time.Second, true},
+		{"not popular", 3, 2, 55 * time.Second, false},
+		{"far from expiry", 2, 2, 50 * time.Second, false},
+		{"disabled", 0, 5, 55 * time.Second, false},
+	}
+	for _, tt := range tests {
+		transport, _, queries := switchTransport(t)
+		cache := NewCache(10)
+		cache.PrefetchHits = tt.hits
+		config := Config{Transport: transport, Cache: cache}
+		ctx := context.Background()
+		if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+			t.Fatal(err)
+		}
+		ageCache(t, cache, "example.com", RR_A, tt.age)
+		for i := 0; i < tt.gets; i++ {
+			if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := int32(1)
+		if tt.prefetch {
+			want = 2
+		}
+		if got := waitQueries(queries, want); got != want {
+			t.Errorf("%v: %v queries, want %v", tt.name, got, want)
+		}
+	}
+}
+
+// после неудачного обновления запись можно обновить снова
+func TestCachePrefetchRetry(t *testing.T) {
+	transport, failing, queries := switchTransport(t)
+	cache := NewCache(10)
+	cache.PrefetchHits = 1
+	config := Config{Transport: transport, Cache: cache}
+	ctx := context.Background()
+	if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	ageCache(t, cache, "example.com", RR_A, 55*time.Second)
+	failing.Store(true)
+	for want := int32(2); want <= 3; want++ {
+		if _, _, err := resolve(ctx, RR_A, "example.com", config); err != nil {
+			t.Fatal(err)
+		}
+		if got := waitQueries(queries, want); got != want {
+			t.Fatalf("%v queries, want %v", got, want)
+		}
+		// ждем, пока фоновое обновление снимет отметку
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			cache.mu.Lock()
+			prefetching := false
+			for _, elem := range cache.entries {
+				prefetching = elem.Value.(*cacheEntry).prefetching
+			}
+			cache.mu.Unlock()
+			if !prefetching {
+				break
+			}
+		}
+	}
+}
+
+// waitQueries ждет want запросов в фоне, но не больше секунды
+func waitQueries(queries *atomic.Int32, want int32) int32 {
+	deadline := time.Now().Add(time.Second)
+	for queries.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// лишний запрос тоже должен успеть прийти
+	time.Sleep(20 * time.Millisecond)
+	return queries.Load()
+}
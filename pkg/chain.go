@@ -0,0 +1,130 @@
+package awesomedns
+
+// следование по цепочкам CNAME (rfc1034 3.6.2) и DNAME (rfc6672). если сервер
+// вернул цепочку не до конца, недостающая часть запрашивается отдельно
+import (
+	"context"
+	"errors"
+)
+
+const (
+	maxChainLength  = 16 // переходов по CNAME и DNAME
+	maxChainQueries = 8  // дозапросов для одного имени
+)
+
+var (
+	errChainLoop    = errors.New("CNAME loop")
+	errChainTooLong = errors.New("CNAME chain is too long")
+)
+
+// resolveChain возвращает каноническое имя и записи типа rrtype, принадлежащие ему.
+// CNAME, DNAME и типы только для запросов (AXFR, ANY) запрашиваются без следования
+func resolveChain(ctx context.Context, rrtype DnsType, qname string, config Config) (string, []DnsRecord, int, error) {
+	if !followsChain(rrtype) {
+		records, transactionId, err := resolve(ctx, rrtype, qname, config)
+		return qname, records, transactionId, err
+	}
+	// имена сравниваются в ascii, в unicode переводится уже результат
+	unicodeNames := config.UnicodeNames
+	config.UnicodeNames = false
+	asciiName, err := ToASCII(qname)
+	if err != nil {
+		return qname, nil, 0, err
+	}
+	target, err := ParseName(asciiName)
+	if err != nil {
+		return qname, nil, 0, err
+	}
+	seen := map[string]bool{target.Lower().String(): true}
+	hops := 0
+	for queries := 0; queries <= maxChainQueries; queries++ {
+		records, transactionId, err := resolve(ctx, rrtype, target.String(), config)
+		if err != nil {
+			return target.String(), nil, transactionId, err
+		}
+		queried := target
+		for {
+			if res := ownedBy(records, rrtype, target); len(res) > 0 {
+				canonical := target.String()
+				if unicodeNames {
+					canonical = ToUnicode(canonical)
+				}
+				return canonical, convertNames(res, unicodeNames), transactionId, nil
+			}
+			next, ok, err := chainStep(records, target)
+			if err != nil {
+				return target.String(), nil, transactionId, err
+			}
+			if !ok {
+				break
+			}
+			if hops++; hops > maxChainLength {
+				return target.String(), nil, transactionId, errChainTooLong
+			}
+			key := next.Lower().String()
+			if seen[key] {
+				return target.String(), nil, transactionId, errChainLoop
+			}
+			seen[key] = true
+			target = next
+		}
+		if target.Equal(queried) {
+			// нет данных нужного типа
+			return target.String(), nil, transactionId, nil
+		}
+	}
+	return target.String(), nil, 0, errChainTooLong
+}
+
+// followsChain false для типов, записей которых в ответе нет: qtype и meta-type
+// 128-255 (rfc6895 3.1), в том числе AXFR, IXFR и ANY, и для самих CNAME и DNAME
+func followsChain(rrtype DnsType) bool {
+	if rrtype == RR_CNAME || rrtype == RR_DNAME || rrtype == RR_OPT {
+		return false
+	}
+	return rrtype < 128 || rrtype > 255
+}
+
+func ownedBy(records []DnsRecord, rrtype DnsType, owner Name) []DnsRecord {
+	var res []DnsRecord
+	for _, rr := range records {
+		if rr.Type != rrtype {
+			continue
+		}
+		if name, err := ParseName(rr.Name); err == nil && name.Equal(owner) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+// chainStep следующее имя цепочки: CNAME самого имени или подстановка по DNAME предка
+func chainStep(records []DnsRecord, target Name) (Name, bool, error) {
+	for _, rr := range records {
+		if rr.Type != RR_CNAME {
+			continue
+		}
+		if owner, err := ParseName(rr.Name); err == nil && owner.Equal(target) {
+			next, err := ParseName(rr.Data.(string))
+			return next, err == nil, err
+		}
+	}
+	for _, rr := range records {
+		if rr.Type != RR_DNAME {
+			continue
+		}
+		owner, err := ParseName(rr.Name)
+		if err != nil || owner.Equal(target) || !target.IsSubdomain(owner) {
+			continue
+		}
+		dname, err := ParseName(rr.Data.(string))
+		if err != nil {
+			return target, false, err
+		}
+		// метки под владельцем DNAME переносятся под его цель
+		prefix := target.labels[:target.NumLabels()-owner.NumLabels()]
+		next, err := NameFromLabels(append(append([]string(nil), prefix...), dname.labels...)...)
+		return next, err == nil, err
+	}
+	return target, false, nil
+}
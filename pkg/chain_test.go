@@ -0,0 +1,169 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chainServer отвечает записями из zone по имени запроса, на остальные имена NXDOMAIN.
+// queries возвращает имена запросов по порядку
+func chainServer(t *testing.T, zone map[string][]testRR) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var names []string
+	server := udpServer(t, func(q []byte) []byte {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil
+		}
+		name := msg.Question[0].Name
+		mu.Lock()
+		names = append(names, name)
+		mu.Unlock()
+		answer, ok := zone[strings.ToLower(name)]
+		if !ok {
+			return testResponse(t, q, 3, nil, nil)
+		}
+		return testResponse(t, q, 0, answer, nil)
+	})
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), names...)
+	}
+}
+
+func TestResolveChain(t *testing.T) {
+	zone := map[string][]testRR{
+		"www.example": {
+			{"www.example", RR_CNAME, 60, "a.example"},
+			{"a.example", RR_A, 60, "192.0.2.1"},
+		},
+		"a.example":       {{"a.example", RR_A, 60, "192.0.2.1"}},
+		"partial.example": {{"partial.example", RR_CNAME, 60, "b.example"}},
+		"b.example":       {{"b.example", RR_A, 60, "192.0.2.2"}},
+		// DNAME без синтезированного CNAME, подстановка на стороне клиента
+		"x.sub.example":   {{"sub.example", RR_DNAME, 60, "other.example"}},
+		"x.other.example": {{"x.other.example", RR_A, 60, "192.0.2.3"}},
+		"nodata.example":  {{"nodata.example", RR_CNAME, 60, "empty.example"}},
+		"empty.example":   nil,
+		"loop1.example": {
+			{"loop1.example", RR_CNAME, 60, "loop2.example"},
+			{"loop2.example", RR_CNAME, 60, "LOOP1.example"},
+		},
+		"dangling.example": {{"dangling.example", RR_CNAME, 60, "missing.example"}},
+	}
+	// длинная цепочка одним ответом
+	var long []testRR
+	for i := 0; i <= maxChainLength; i++ {
+		long = append(long, testRR{fmt.Sprintf("long%v.example", i), RR_CNAME, 60, fmt.Sprintf("long%v.example", i+1)})
+	}
+	zone["long0.example"] = long
+	// цепочка, где каждый ответ дает один шаг и требует дозапроса
+	var steps []string
+	for i := 0; i <= maxChainQueries+1; i++ {
+		name := fmt.Sprintf("step%v.example", i)
+		zone[name] = []testRR{{name, RR_CNAME, 60, fmt.Sprintf("step%v.example", i+1)}}
+		if i <= maxChainQueries {
+			steps = append(steps, name)
+		}
+	}
+	server, queries := chainServer(t, zone)
+	r := NewResolver(Config{Server: server})
+
+	a := func(ip string) []interface{} { return []interface{}{net.ParseIP(ip).To4()} }
+	tests := []struct {
+		rrtype    DnsType
+		qname     string
+		canonical string
+		want      []interface{}
+		err       error
+		queries   []string
+	}{
+		{RR_A, "www.example", "a.example", a("192.0.2.1"), nil, []string{"www.example"}},
+		{RR_A, "WWW.Example", "a.example", a("192.0.2.1"), nil, []string{"WWW.Example"}},
+		// сервер вернул цепочку не до конца
+		{RR_A, "partial.example", "b.example", a("192.0.2.2"), nil, []string{"partial.example", "b.example"}},
+		{RR_A, "x.sub.example", "x.other.example", a("192.0.2.3"), nil, []string{"x.sub.example", "x.other.example"}},
+		{RR_A, "nodata.example", "empty.example", nil, nil, []string{"nodata.example", "empty.example"}},
+		{RR_A, "dangling.example", "missing.example", nil, errNameError, []string{"dangling.example", "missing.example"}},
+		{RR_A, "loop1.example", "loop2.example", nil, errChainLoop, []string{"loop1.example"}},
+		{RR_A, "long0.example", "", nil, errChainTooLong, []string{"long0.example"}},
+		{RR_A, "step0.example", "", nil, errChainTooLong, steps},
+		// CNAME запрашивается как есть
+		{RR_CNAME, "partial.example", "partial.example", []interface{}{"b.example"}, nil, []string{"partial.example"}},
+	}
+	for _, tt := range tests {
+		n := len(queries())
+		res, err := r.Lookup(context.Background(), tt.rrtype, tt.qname)
+		name := RRnames[tt.rrtype] + " " + tt.qname
+		if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%v: err = %v, want %v", name, err, tt.err)
+		}
+		if tt.canonical != "" && res.Canonical != tt.canonical {
+			t.Errorf("%v: canonical %q, want %q", name, res.Canonical, tt.canonical)
+		}
+		if !reflect.DeepEqual(res.Records, tt.want) {
+			t.Errorf("%v: records %v, want %v", name, res.Records, tt.want)
+		}
+		if got := queries()[n:]; !reflect.DeepEqual(got, tt.queries) {
+			t.Errorf("%v: queries %q, want %q", name, got, tt.queries)
+		}
+	}
+}
+
+func TestChainStep(t *testing.T) {
+	record := func(name string, typ DnsType, data string) DnsRecord {
+		return DnsRecord{DnsAnswerHeader: DnsAnswerHeader{Name: name, Type: typ, Class: ClassIN}, Data: data}
+	}
+	tests := []struct {
+		records []DnsRecord
+		target  string
+		want    string
+		ok      bool
+	}{
+		{[]DnsRecord{record("a.example", RR_CNAME, "b.example")}, "A.EXAMPLE", "b.example", true},
+		{[]DnsRecord{record("sub.example", RR_DNAME, "other.net")}, "x.y.sub.example", "x.y.other.net", true},
+		// DNAME не действует на свое имя
+		{[]DnsRecord{record("sub.example", RR_DNAME, "other.net")}, "sub.example", "sub.example", false},
+		// CNAME имени важнее DNAME предка
+		{[]DnsRecord{record("sub.example", RR_DNAME, "other.net"), record("x.sub.example", RR_CNAME, "c.example")}, "x.sub.example", "c.example", true},
+		{[]DnsRecord{record("b.example", RR_CNAME, "c.example")}, "a.example", "a.example", false},
+	}
+	for _, tt := range tests {
+		target, err := ParseName(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, ok, err := chainStep(tt.records, target)
+		if err != nil || ok != tt.ok || next.String() != tt.want {
+			t.Errorf("chainStep(%v) = %v, %v, %v, want %v, %v", tt.target, next, ok, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFollowsChain(t *testing.T) {
+	tests := []struct {
+		rrtype DnsType
+		want   bool
+	}{
+		{RR_A, true},
+		{RR_MX, true},
+		{RR_CNAME, false},
+		{RR_DNAME, false},
+		{RR_AXFR, false},
+		{RR_ANY, false},
+		{DnsType(300), true},
+	}
+	for _, tt := range tests {
+		if got := followsChain(tt.rrtype); got != tt.want {
+			t.Errorf("followsChain(%v) = %v", tt.rrtype, got)
+		}
+	}
+}
@@ -1,217 +1,283 @@
 package awesomedns
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
-	"reflect"
+	"net/netip"
+	"os"
 	"time"
 )
 
 func ResolveA(qname string, config Config) ([]net.IP, error) {
-	var ret []net.IP
-	res, _, err := Resolve(RR_A, qname, config)
-	if err != nil {
-		return nil, err
-	}
-	for _, v := range res {
-		switch v.(type) {
-		case net.IP:
-			ret = append(ret, v.(net.IP))
-		case string:
-			//log.Printf("cname received %v", v)
-		default:
-			return nil, errors.New("unknown")
-		}
-	}
-	return ret, nil
+	return NewResolver(config).ResolveA(context.Background(), qname)
 }
 
 func ResolveAaaa(qname string, config Config) ([]net.IP, error) {
-	var ret []net.IP
-	res, _, err := Resolve(RR_AAAA, qname, config)
-	if err != nil {
-		return nil, err
-	}
-	for _, v := range res {
-		switch v.(type) {
-		case net.IP:
-			ret = append(ret, v.(net.IP))
-		default:
-			return nil, errors.New("unknown")
-		}
-	}
-	return ret, nil
+	return NewResolver(config).ResolveAaaa(context.Background(), qname)
 }
 
 func ResolveCname(qname string, config Config) ([]string, error) {
-	var ret []string
-	res, _, err := Resolve(RR_CNAME, qname, config)
-	if err != nil {
-		return nil, err
-	}
-	for _, v := range res {
-		switch v.(type) {
-		case string:
-			ret = append(ret, v.(string))
-		default:
-			return nil, fmt.Errorf("unknown type - %v", v)
-		}
-	}
-	return ret, nil
+	return NewResolver(config).ResolveCname(context.Background(), qname)
 }
 
 func Resolve_NS(qname string, config Config) ([]string, error) {
-	var ret []string
-	res, _, err := Resolve(RR_NS, qname, config)
-	if err != nil {
-		return nil, err
+	return NewResolver(config).ResolveNs(context.Background(), qname)
+}
+
+func ResolveSoa(qname string, config Config) ([]DnsSoa, error) {
+	return NewResolver(config).ResolveSoa(context.Background(), qname)
+}
+
+func ResolvePtr(qname string, config Config) ([]string, error) {
+	return NewResolver(config).ResolvePtr(context.Background(), qname)
+}
+
+func ResolvePtrAddr(addr netip.Addr, config Config) ([]string, error) {
+	return NewResolver(config).ResolvePtrAddr(context.Background(), addr)
+}
+
+func ResolveMx(qname string, config Config) ([]DnsMx, error) {
+	return NewResolver(config).ResolveMx(context.Background(), qname)
+}
+
+func ResolveSrv(qname string, config Config) ([]DnsSRV, error) {
+	return NewResolver(config).ResolveSrv(context.Background(), qname)
+}
+
+func ResolveAny(qname string, config Config) ([]interface{}, error) {
+	return NewResolver(config).ResolveAny(context.Background(), qname)
+}
+
+func Resolve(rrtype DnsType, qname string, config Config) ([]interface{}, int, error) {
+	return NewResolver(config).Resolve(context.Background(), rrtype, qname)
+}
+
+// resolve ответ из кэша или от серверов. в кэш записи попадают в ascii,
+// в unicode они переводятся при выдаче
+func resolve(ctx context.Context, rrtype DnsType, qname string, config Config) ([]DnsRecord, int, error) {
+	records, ok, err := config.Cache.get(qname, rrtype, func() {
+		go func() {
+			if _, _, err := fetch(context.Background(), rrtype, qname, config); err != nil {
+				config.Cache.prefetchFailed(qname, rrtype)
+			}
+		}()
+	})
+	if ok {
+		return convertNames(records, config.UnicodeNames), 0, err
 	}
-	for _, v := range res {
-		switch v.(type) {
-		case string:
-			ret = append(ret, v.(string))
-		default:
-			return nil, fmt.Errorf("unknown type - %v", v)
+	records, transactionId, err := fetch(ctx, rrtype, qname, config)
+	if err != nil && !errors.Is(err, errNameError) && !errors.Is(err, context.Canceled) {
+		// все серверы отказали, устаревший ответ лучше никакого
+		if stale, ok, staleErr := config.Cache.stale(qname, rrtype); ok {
+			config.logger().Warn("serve stale", "qname", qname, "type", RRnames[rrtype], "err", err)
+			return convertNames(stale, config.UnicodeNames), 0, staleErr
 		}
 	}
-	return ret, nil
+	if err != nil {
+		return nil, transactionId, err
+	}
+	return convertNames(records, config.UnicodeNames), transactionId, nil
 }
 
-func ResolveSoa(qname string, config Config) ([]DnsSoa, error) {
-	var ret []DnsSoa
-	res, _, err := Resolve(RR_SOA, qname, config)
+// fetch запрос к серверам, ответ сохраняется в кэш
+func fetch(ctx context.Context, rrtype DnsType, qname string, config Config) ([]DnsRecord, int, error) {
+	var response []byte
+	var err error
+	if config.Iterative != nil {
+		response, err = config.Iterative.lookup(ctx, rrtype, qname, config, 0)
+	} else {
+		response, err = resolveUpstreams(ctx, func() ([]byte, error) {
+			return newQuery(rrtype, qname, config)
+		}, config)
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	for _, v := range res {
-		switch v.(type) {
-		case DnsSoa:
-			ret = append(ret, v.(DnsSoa))
-		default:
-			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
-		}
+	records, transactionId, err := parseDnsRecords(response, false)
+	config.logger().Debug("answer", "qname", qname, "type", RRnames[rrtype], "id", transactionId, "records", records, "err", err)
+	config.Cache.store(qname, rrtype, response, records, err)
+	return records, transactionId, err
+}
+
+// convertNames переводит имена в unicode в копии: records могут быть общими с кэшем
+func convertNames(records []DnsRecord, unicodeNames bool) []DnsRecord {
+	if !unicodeNames || len(records) == 0 {
+		return records
+	}
+	res := make([]DnsRecord, len(records))
+	for i, rr := range records {
+		res[i] = rr.unicodeNames()
 	}
-	return ret, nil
+	return res
 }
 
-func ResolvePtr(qname string, config Config) ([]string, error) {
-	var ret []string
-	qname += ".in-addr.arpa"
-	res, _, err := Resolve(RR_PTR, qname, config)
-	if err != nil {
-		return nil, err
+// resolveUpstreams опрашивает серверы по очереди, переходя к следующему при отказе сервера.
+// query дает запрос для каждой попытки
+func resolveUpstreams(ctx context.Context, query func() ([]byte, error), config Config) ([]byte, error) {
+	upstreams := config.upstreams()
+	if len(upstreams) == 0 {
+		return nil, errNoServers
 	}
-	for _, v := range res {
-		switch v.(type) {
-		case string:
-			ret = append(ret, v.(string))
-		default:
-			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
+	attempts := config.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	start := config.firstServer(len(upstreams))
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		for i := range upstreams {
+			upstream := upstreams[(start+i)%len(upstreams)]
+			response, err := resolveServer(ctx, query, upstream.transport, config)
+			if err == nil || !isRetryable(err) {
+				return response, err
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			config.logger().Warn("server failed", "server", upstream.name, "err", err)
+			if attempt < attempts-1 || i < len(upstreams)-1 {
+				config.Metrics.retry(upstream.name)
+			}
+			lastErr = err
 		}
 	}
-	return ret, nil
+	return nil, lastErr
 }
 
-func ResolveMx(qname string, config Config) ([]DnsMx, error) {
-	var ret []DnsMx
-	res, _, err := Resolve(RR_MX, qname, config)
+// resolveServer ответ одного сервера. NXDOMAIN - ответ, остальные коды ошибок - отказ сервера
+func resolveServer(ctx context.Context, query func() ([]byte, error), transport Transport, config Config) ([]byte, error) {
+	q, err := query()
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range res {
-		switch v.(type) {
-		case DnsMx:
-			ret = append(ret, v.(DnsMx))
-		default:
-			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
-		}
+	response, err := exchangeServer(ctx, transport, q, config)
+	if err != nil {
+		return nil, err
 	}
-	return ret, nil
-}
-
-func ResolveSrv(qname string, config Config) ([]DnsSRV, error) {
-	var ret []DnsSRV
-	res, _, err := Resolve(RR_SRV, qname, config)
+	header, err := parseDnsHeader(response)
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range res {
-		switch v.(type) {
-		case DnsSRV:
-			ret = append(ret, v.(DnsSRV))
-		default:
-			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
-		}
+	if err = rcodeError(header.RCode); err != nil && !errors.Is(err, errNameError) {
+		return nil, err
 	}
-	return ret, nil
+	return response, nil
 }
 
-func ResolveAny(qname string, config Config) ([]interface{}, error) {
-	res, _, err := Resolve(RR_ANY, qname, config)
+// exchangeCtxKey контекст до таймаута exchangeServer, от него отсчитывается
+// таймаут повтора по tcp после обрезанного ответа
+type exchangeCtxKey struct{}
+
+// exchangeServer обмен с одним сервером с таймаутом из config
+func exchangeServer(ctx context.Context, transport Transport, q []byte, config Config) ([]byte, error) {
+	ctx, cancel := config.exchangeContext(context.WithValue(ctx, exchangeCtxKey{}, ctx), config.isTCP())
+	defer cancel()
+	response, err := transport.Exchange(ctx, q)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	return res, nil
-}
-
-func Resolve(rrtype DnsType, qname string, config Config) ([]interface{}, int, error) {
-	return resolve(rrtype, qname, config)
+	// встроенные транспорты проверяют ответ сами, внешние могут и не проверять
+	if err = verifyResponse(q, response, config.Randomize0x20); err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
-func resolve(rrtype DnsType, qname string, config Config) ([]interface{}, int, error) {
-	var transactionId int
-	var buffer []byte
-	var read, written, datasize_int int
-	isTCP := config.IsTCP
+// exchangeDial обмен через новое соединение
+func exchangeDial(ctx context.Context, server string, q []byte, isTCP bool, config Config) ([]byte, error) {
 	proto := "udp"
 	if isTCP {
 		proto = "tcp"
 	}
-	conn, err := net.Dial(proto, config.Server)
+	dialer, err := config.dialer(proto)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, proto, server)
 
 	if err != nil {
-		return nil, transactionId, err
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// отмена контекста прерывает запись и чтение
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	response, err := exchangeConn(conn, q, isTCP, config)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// дедлайн соединения взят из ctx, таймер ctx может сработать чуть позже
+		<-ctx.Done()
 	}
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-	q, err := makeQuery(rrtype, qname, 234)
+	return response, err
+}
+
+// exchangeRecorded обмен через пул или транспорт, который сам управляет соединениями
+func exchangeRecorded(ctx context.Context, exchange func(context.Context, string, []byte) ([]byte, net.Addr, net.Addr, error), server string, q []byte, protocol int, config Config) ([]byte, error) {
+	sent := time.Now()
+	response, local, remote, err := exchange(ctx, server, q)
 	if err != nil {
-		return nil, transactionId, err
+		return nil, err
+	}
+	config.Pcap.record(config.logger(), local, remote, q)
+	config.Dnstap.recordQuery(config.logger(), protocol, local, remote, q)
+	config.Pcap.record(config.logger(), remote, local, response)
+	config.Dnstap.recordResponse(config.logger(), protocol, sent, local, remote, response)
+	if err = verifyResponse(q, response, config.Randomize0x20); err != nil {
+		return nil, err
 	}
+	return response, nil
+}
+
+func exchangeConn(conn net.Conn, q []byte, isTCP bool, config Config) ([]byte, error) {
+	var buffer []byte
+	var read, written, datasize_int int
+	var err error
 	if isTCP { // в tcp надо записать еще и размер данных
 		wsize := make([]byte, 2)
 		binary.BigEndian.PutUint16(wsize, uint16(len(q)))
 		written, err := conn.Write(wsize)
 		if err != nil {
-			return nil, transactionId, err
+			return nil, err
 		}
 		if written != 2 {
-			return nil, transactionId, errors.New("wrong read")
+			return nil, errors.New("wrong read")
 		}
 	}
 
 	written, err = conn.Write(q)
 
 	if err != nil {
-		return nil, transactionId, err
+		return nil, err
 	}
 	if written != len(q) {
-		return nil, transactionId, errors.New("wrong write")
+		return nil, errors.New("wrong write")
 	}
+	sent := time.Now()
+	config.Pcap.record(config.logger(), conn.LocalAddr(), conn.RemoteAddr(), q)
+	config.Dnstap.recordQuery(config.logger(), addrProtocol(conn.LocalAddr()), conn.LocalAddr(), conn.RemoteAddr(), q)
 
 	if isTCP {
 		datasize := make([]byte, 2)
-		read, err := conn.Read(datasize)
+		read, err := io.ReadFull(conn, datasize)
 		if err != nil {
-			return nil, transactionId, err
+			return nil, err
 		}
 		if read != 2 {
-			return nil, transactionId, errors.New("wrong read")
+			return nil, errors.New("wrong read")
 		}
 		datasize_int = int(binary.BigEndian.Uint16(datasize))
 		buffer = make([]byte, datasize_int, datasize_int)
+	} else if config.Edns0 {
+		buffer = make([]byte, defaultEdnsUDPSize)
 	} else {
 		buffer = make([]byte, 1024)
 	}
@@ -219,17 +285,32 @@ func resolve(rrtype DnsType, qname string, config Config) ([]interface{}, int, e
 	if isTCP {
 		read, err = io.ReadFull(conn, buffer)
 		if err != nil {
-			return nil, transactionId, err
+			return nil, err
 		}
 		if datasize_int > 0 && read != datasize_int {
-			return nil, transactionId, errors.New("wrong read")
+			return nil, errors.New("wrong read")
+		}
+		config.Pcap.record(config.logger(), conn.RemoteAddr(), conn.LocalAddr(), buffer[:read])
+		config.Dnstap.recordResponse(config.logger(), addrProtocol(conn.LocalAddr()), sent, conn.LocalAddr(), conn.RemoteAddr(), buffer[:read])
+		if err = verifyResponse(q, buffer, config.Randomize0x20); err != nil {
+			return nil, err
 		}
 	} else {
-		read, err = conn.Read(buffer)
-		if err != nil {
-			return nil, transactionId, err
+		// чужие ответы не прерывают ожидание, иначе подделка работает как отказ в обслуживании
+		for {
+			read, err = readFromServer(conn, buffer)
+			if err != nil {
+				return nil, err
+			}
+			config.Pcap.record(config.logger(), conn.RemoteAddr(), conn.LocalAddr(), buffer[:read])
+			config.Dnstap.recordResponse(config.logger(), addrProtocol(conn.LocalAddr()), sent, conn.LocalAddr(), conn.RemoteAddr(), buffer[:read])
+			err = verifyResponse(q, buffer[:read], config.Randomize0x20)
+			if err == nil {
+				break
+			}
+			config.logger().Warn("drop response", "server", conn.RemoteAddr(), "err", err)
 		}
 	}
 
-	return parseDnsAnswer(buffer)
+	return buffer[:read], nil
 }
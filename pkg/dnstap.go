@@ -0,0 +1,267 @@
+package awesomedns
+
+// запись dnstap (https://dnstap.info) - protobuf сообщения поверх Frame Streams.
+// в файл пишется однонаправленный поток, в unix сокет - двунаправленный с рукопожатием
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// управляющие кадры Frame Streams
+const (
+	fstrmControlAccept = 1
+	fstrmControlStart  = 2
+	fstrmControlStop   = 3
+	fstrmControlReady  = 4
+	fstrmControlFinish = 5
+
+	fstrmFieldContentType = 1
+)
+
+// типы из dnstap.proto
+const (
+	dnstapTypeMessage = 1
+
+	dnstapToolQuery    = 11
+	dnstapToolResponse = 12
+
+	dnstapFamilyInet  = 1
+	dnstapFamilyInet6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	dnstapProtocolDOT = 3
+	dnstapProtocolDOH = 4
+)
+
+var errFstrmHandshake = errors.New("frame streams handshake failed")
+
+// DnstapWriter пишет запросы и ответы как TOOL_QUERY/TOOL_RESPONSE.
+// можно использовать из нескольких горутин
+type DnstapWriter struct {
+	Identity string
+	Version  string
+
+	mu     sync.Mutex
+	w      io.Writer
+	conn   net.Conn // только для двунаправленного режима
+	closed bool
+}
+
+// NewDnstapWriter начинает однонаправленный поток, например в файл
+func NewDnstapWriter(w io.Writer) (*DnstapWriter, error) {
+	dw := &DnstapWriter{w: w}
+	if err := writeControlFrame(w, fstrmControlStart, dnstapContentType); err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+// DialDnstap подключается к коллектору через unix сокет
+func DialDnstap(path string) (*DnstapWriter, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err = writeControlFrame(conn, fstrmControlReady, dnstapContentType); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = readControlFrame(conn, fstrmControlAccept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = writeControlFrame(conn, fstrmControlStart, dnstapContentType); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &DnstapWriter{w: conn, conn: conn}, nil
+}
+
+// Close завершает поток. сокет закрывается, io.Writer остается открытым
+func (dw *DnstapWriter) Close() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.closed {
+		return nil
+	}
+	dw.closed = true
+	err := writeControlFrame(dw.w, fstrmControlStop, "")
+	if dw.conn != nil {
+		if err == nil {
+			dw.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			err = readControlFrame(dw.conn, fstrmControlFinish)
+		}
+		dw.conn.Close()
+	}
+	return err
+}
+
+// WriteQuery записывает запрос, отправленный с local на server.
+// протокол UDP или TCP определяется по типу адреса
+func (dw *DnstapWriter) WriteQuery(t time.Time, local, server net.Addr, msg []byte) error {
+	return dw.writeMessage(dnstapToolQuery, addrProtocol(local), t, time.Time{}, local, server, msg)
+}
+
+// WriteResponse записывает ответ от server. queryTime можно не указывать
+func (dw *DnstapWriter) WriteResponse(queryTime, t time.Time, local, server net.Addr, msg []byte) error {
+	return dw.writeMessage(dnstapToolResponse, addrProtocol(local), queryTime, t, local, server, msg)
+}
+
+func addrProtocol(addr net.Addr) int {
+	if _, ok := addr.(*net.TCPAddr); ok {
+		return dnstapProtocolTCP
+	}
+	return dnstapProtocolUDP
+}
+
+func (dw *DnstapWriter) writeMessage(typ, protocol int, queryTime, responseTime time.Time, local, server net.Addr, msg []byte) error {
+	var m []byte
+	m = appendVarintField(m, 1, uint64(typ))
+	var localIp, serverIp net.IP
+	var localPort, serverPort int
+	switch addr := local.(type) {
+	case *net.UDPAddr:
+		localIp, localPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		localIp, localPort = addr.IP, addr.Port
+	}
+	switch addr := server.(type) {
+	case *net.UDPAddr:
+		serverIp, serverPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		serverIp, serverPort = addr.IP, addr.Port
+	}
+	if localIp != nil && serverIp != nil {
+		family := dnstapFamilyInet6
+		if localIp.To4() != nil && serverIp.To4() != nil {
+			family = dnstapFamilyInet
+			localIp, serverIp = localIp.To4(), serverIp.To4()
+		} else {
+			localIp, serverIp = localIp.To16(), serverIp.To16()
+		}
+		m = appendVarintField(m, 2, uint64(family))
+		m = appendVarintField(m, 3, uint64(protocol))
+		m = appendBytesField(m, 4, localIp)
+		m = appendBytesField(m, 5, serverIp)
+		m = appendVarintField(m, 6, uint64(localPort))
+		m = appendVarintField(m, 7, uint64(serverPort))
+	}
+	if !queryTime.IsZero() {
+		m = appendVarintField(m, 8, uint64(queryTime.Unix()))
+		m = appendFixed32Field(m, 9, uint32(queryTime.Nanosecond()))
+	}
+	if typ == dnstapToolQuery {
+		m = appendBytesField(m, 10, msg)
+	} else {
+		m = appendVarintField(m, 12, uint64(responseTime.Unix()))
+		m = appendFixed32Field(m, 13, uint32(responseTime.Nanosecond()))
+		m = appendBytesField(m, 14, msg)
+	}
+
+	var frame []byte
+	if dw.Identity != "" {
+		frame = appendBytesField(frame, 1, []byte(dw.Identity))
+	}
+	if dw.Version != "" {
+		frame = appendBytesField(frame, 2, []byte(dw.Version))
+	}
+	frame = appendBytesField(frame, 14, m)
+	frame = appendVarintField(frame, 15, dnstapTypeMessage)
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.closed {
+		return errors.New("dnstap writer is closed")
+	}
+	buf := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	_, err := dw.w.Write(append(buf, frame...))
+	return err
+}
+
+// recordQuery и recordResponse пишут сообщение, если запись включена. ошибки только логируются
+func (dw *DnstapWriter) recordQuery(logger *slog.Logger, protocol int, local, server net.Addr, msg []byte) {
+	if dw == nil {
+		return
+	}
+	if err := dw.writeMessage(dnstapToolQuery, protocol, time.Now(), time.Time{}, local, server, msg); err != nil {
+		logger.Error("unable to write dnstap", "err", err)
+	}
+}
+
+func (dw *DnstapWriter) recordResponse(logger *slog.Logger, protocol int, queryTime time.Time, local, server net.Addr, msg []byte) {
+	if dw == nil {
+		return
+	}
+	if err := dw.writeMessage(dnstapToolResponse, protocol, queryTime, time.Now(), local, server, msg); err != nil {
+		logger.Error("unable to write dnstap", "err", err)
+	}
+}
+
+func writeControlFrame(w io.Writer, typ uint32, contentType string) error {
+	body := binary.BigEndian.AppendUint32(nil, typ)
+	if contentType != "" {
+		body = binary.BigEndian.AppendUint32(body, fstrmFieldContentType)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(contentType)))
+		body = append(body, contentType...)
+	}
+	// нулевая длина означает управляющий кадр
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+func readControlFrame(r io.Reader, expected uint32) error {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(head[4:])
+	if binary.BigEndian.Uint32(head) != 0 || length < 4 || length > 512 {
+		return errFstrmHandshake
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if typ := binary.BigEndian.Uint32(body); typ != expected {
+		return fmt.Errorf("%w: unexpected control frame %v", errFstrmHandshake, typ)
+	}
+	return nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
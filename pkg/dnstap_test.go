@@ -0,0 +1,303 @@
+package awesomedns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fstrmFrame кадр Frame Streams. у кадров данных control равен 0
+type fstrmFrame struct {
+	control     uint32
+	contentType string
+	data        []byte
+}
+
+func readFstrmFrame(r io.Reader) (fstrmFrame, error) {
+	var frame fstrmFrame
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return frame, err
+	}
+	length := binary.BigEndian.Uint32(head)
+	escape := length == 0
+	if escape {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return frame, err
+		}
+		length = binary.BigEndian.Uint32(head)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return frame, err
+	}
+	if !escape {
+		frame.data = body
+		return frame, nil
+	}
+	frame.control = binary.BigEndian.Uint32(body)
+	for pos := 4; pos+8 <= len(body); {
+		field, size := binary.BigEndian.Uint32(body[pos:]), int(binary.BigEndian.Uint32(body[pos+4:]))
+		pos += 8
+		if field == fstrmFieldContentType {
+			frame.contentType = string(body[pos : pos+size])
+		}
+		pos += size
+	}
+	return frame, nil
+}
+
+// protoFields поля protobuf сообщения: varint и fixed32 как uint64, bytes как []byte
+func protoFields(t *testing.T, b []byte) map[int]interface{} {
+	t.Helper()
+	fields := map[int]interface{}{}
+	varint := func() uint64 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			if len(b) == 0 {
+				t.Fatal("truncated varint")
+			}
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(b) > 0 {
+		key := varint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			fields[field] = varint()
+		case 2:
+			n := varint()
+			fields[field] = b[:n]
+			b = b[n:]
+		case 5:
+			fields[field] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("wire type %v", key&7)
+		}
+	}
+	return fields
+}
+
+// dnstapMessage поля Message из кадра данных, identity и version проверяются
+func dnstapMessage(t *testing.T, frame fstrmFrame) map[int]interface{} {
+	t.Helper()
+	outer := protoFields(t, frame.data)
+	if outer[15] != uint64(dnstapTypeMessage) {
+		t.Fatalf("dnstap type %v", outer[15])
+	}
+	return protoFields(t, outer[14].([]byte))
+}
+
+func TestDnstapMessage(t *testing.T) {
+	queryTime := time.Unix(1700000000, 250)
+	responseTime := time.Unix(1700000001, 500)
+	msg := []byte{1, 2, 3}
+	udpLocal := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	udpRemote := &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}
+	tcpLocal := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	tcpRemote := &net.TCPAddr{IP: net.ParseIP("2001:db8::53"), Port: 853}
+	v4 := func(s string) []byte { return net.ParseIP(s).To4() }
+	v6 := func(s string) []byte { return net.ParseIP(s).To16() }
+	tests := []struct {
+		name  string
+		write func(dw *DnstapWriter) error
+		want  map[int]interface{}
+	}{
+		{"udp query", func(dw *DnstapWriter) error {
+			return dw.WriteQuery(queryTime, udpLocal, udpRemote, msg)
+		}, map[int]interface{}{1: uint64(dnstapToolQuery), 2: uint64(dnstapFamilyInet), 3: uint64(dnstapProtocolUDP),
+			4: v4("192.0.2.1"), 5: v4("192.0.2.53"), 6: uint64(5353), 7: uint64(53),
+			8: uint64(1700000000), 9: uint64(250), 10: msg}},
+		{"tcp response", func(dw *DnstapWriter) error {
+			return dw.WriteResponse(queryTime, responseTime, tcpLocal, tcpRemote, msg)
+		}, map[int]interface{}{1: uint64(dnstapToolResponse), 2: uint64(dnstapFamilyInet6), 3: uint64(dnstapProtocolTCP),
+			4: v6("2001:db8::1"), 5: v6("2001:db8::53"), 6: uint64(40000), 7: uint64(853),
+			8: uint64(1700000000), 9: uint64(250), 12: uint64(1700000001), 13: uint64(500), 14: msg}},
+		{"mixed families", func(dw *DnstapWriter) error {
+			return dw.WriteQuery(queryTime, udpLocal, &net.UDPAddr{IP: net.ParseIP("2001:db8::53"), Port: 53}, msg)
+		}, map[int]interface{}{1: uint64(dnstapToolQuery), 2: uint64(dnstapFamilyInet6), 3: uint64(dnstapProtocolUDP),
+			4: v6("::ffff:192.0.2.1"), 5: v6("2001:db8::53"), 6: uint64(5353), 7: uint64(53),
+			8: uint64(1700000000), 9: uint64(250), 10: msg}},
+		{"response without addresses and query time", func(dw *DnstapWriter) error {
+			return dw.WriteResponse(time.Time{}, responseTime, nil, nil, msg)
+		}, map[int]interface{}{1: uint64(dnstapToolResponse), 12: uint64(1700000001), 13: uint64(500), 14: msg}},
+		{"protocol given by the caller", func(dw *DnstapWriter) error {
+			return dw.writeMessage(dnstapToolQuery, dnstapProtocolTCP, queryTime, time.Time{}, udpLocal, udpRemote, msg)
+		}, map[int]interface{}{1: uint64(dnstapToolQuery), 2: uint64(dnstapFamilyInet), 3: uint64(dnstapProtocolTCP),
+			4: v4("192.0.2.1"), 5: v4("192.0.2.53"), 6: uint64(5353), 7: uint64(53),
+			8: uint64(1700000000), 9: uint64(250), 10: msg}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		dw, err := NewDnstapWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dw.Identity, dw.Version = "resolver", "1.0"
+		if err := tt.write(dw); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if _, err := readFstrmFrame(&buf); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := readFstrmFrame(&buf)
+		if err != nil || frame.control != 0 {
+			t.Fatalf("%v: frame %+v, %v", tt.name, frame, err)
+		}
+		outer := protoFields(t, frame.data)
+		if string(outer[1].([]byte)) != "resolver" || string(outer[2].([]byte)) != "1.0" {
+			t.Errorf("%v: identity %q, version %q", tt.name, outer[1], outer[2])
+		}
+		if got := dnstapMessage(t, frame); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v:\n got %v\nwant %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDnstapFileStream(t *testing.T) {
+	var buf bytes.Buffer
+	dw, err := NewDnstapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.WriteQuery(time.Now(), nil, nil, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := dw.WriteQuery(time.Now(), nil, nil, []byte{1}); err == nil {
+		t.Error("write after Close succeeded")
+	}
+	want := []fstrmFrame{{control: fstrmControlStart, contentType: dnstapContentType}, {}, {control: fstrmControlStop}}
+	for i, w := range want {
+		frame, err := readFstrmFrame(&buf)
+		if err != nil || frame.control != w.control || frame.contentType != w.contentType || (w.control == 0) != (frame.data != nil) {
+			t.Errorf("frame %v: %+v, %v, want %+v", i, frame, err, w)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%v bytes after STOP", buf.Len())
+	}
+}
+
+func TestDnstapSocketHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   uint32 // ответ на READY
+		finish   uint32 // ответ на STOP
+		dialErr  bool
+		closeErr bool
+	}{
+		{"bidirectional", fstrmControlAccept, fstrmControlFinish, false, false},
+		{"no ACCEPT", fstrmControlFinish, 0, true, false},
+		{"no FINISH", fstrmControlAccept, fstrmControlAccept, false, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "dnstap.sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := make(chan []fstrmFrame, 1)
+		go func() {
+			var got []fstrmFrame
+			defer func() { frames <- got }()
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for _, reply := range []uint32{tt.accept, tt.finish} {
+				for {
+					frame, err := readFstrmFrame(conn)
+					if err != nil {
+						return
+					}
+					got = append(got, frame)
+					if frame.control == fstrmControlReady || frame.control == fstrmControlStop {
+						break
+					}
+				}
+				if reply != 0 {
+					writeControlFrame(conn, reply, dnstapContentType)
+				}
+			}
+		}()
+		dw, err := DialDnstap(path)
+		if (err != nil) != tt.dialErr || (err != nil && !errors.Is(err, errFstrmHandshake)) {
+			t.Errorf("%v: DialDnstap = %v", tt.name, err)
+		}
+		if err == nil {
+			dw.WriteQuery(time.Now(), nil, nil, []byte{1})
+			err = dw.Close()
+			if (err != nil) != tt.closeErr || (err != nil && !errors.Is(err, errFstrmHandshake)) {
+				t.Errorf("%v: Close = %v", tt.name, err)
+			}
+		}
+		l.Close()
+		got := <-frames
+		if !tt.dialErr {
+			var controls []uint32
+			for _, frame := range got {
+				controls = append(controls, frame.control)
+			}
+			if want := []uint32{fstrmControlReady, fstrmControlStart, 0, fstrmControlStop}; !reflect.DeepEqual(controls, want) {
+				t.Errorf("%v: frames %v, want %v", tt.name, controls, want)
+			}
+			if got[0].contentType != dnstapContentType || got[1].contentType != dnstapContentType {
+				t.Errorf("%v: content types %q, %q", tt.name, got[0].contentType, got[1].contentType)
+			}
+		}
+	}
+}
+
+func TestDnstapRecordsResolve(t *testing.T) {
+	server := udpServer(t, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.10"}}, nil)
+	})
+	var buf bytes.Buffer
+	dw, err := NewDnstapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveA("example.com", Config{Server: server, Dnstap: dw}); err != nil {
+		t.Fatal(err)
+	}
+	readFstrmFrame(&buf)
+	for _, typ := range []int{dnstapToolQuery, dnstapToolResponse} {
+		frame, err := readFstrmFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := dnstapMessage(t, frame)
+		if m[1] != uint64(typ) || m[3] != uint64(dnstapProtocolUDP) || m[7] != uint64(udpPort(t, server)) {
+			t.Errorf("type %v: %v", typ, m)
+		}
+	}
+}
+
+func udpPort(t *testing.T, addr string) int {
+	t.Helper()
+	udp, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return udp.Port
+}
@@ -0,0 +1,136 @@
+package awesomedns
+
+// DNS-over-HTTPS (rfc8484). запрос передается как application/dns-message
+// в теле POST или в параметре dns у GET
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+)
+
+const dohMediaType = "application/dns-message"
+
+type DoHConfig struct {
+	// шаблон адреса, например https://dns.example/dns-query{?dns}
+	URL string
+	// http.MethodGet или http.MethodPost, по умолчанию POST
+	Method string
+	// клиент для запросов. по умолчанию свой, с HTTP/2
+	Client *http.Client
+}
+
+// DoH транспорт для Config.HTTPS
+type DoH struct {
+	url    string
+	method string
+	client *http.Client
+}
+
+func NewDoH(config DoHConfig) (*DoH, error) {
+	if !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "http://") {
+		return nil, fmt.Errorf("wrong DoH url %v", config.URL)
+	}
+	d := &DoH{url: config.URL, method: config.Method, client: config.Client}
+	switch d.method {
+	case "":
+		d.method = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported DoH method %v", config.Method)
+	}
+	if d.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ForceAttemptHTTP2 = true
+		d.client = &http.Client{Transport: transport}
+	}
+	return d, nil
+}
+
+// Exchange отправляет запрос по шаблону адреса template
+func (d *DoH) Exchange(ctx context.Context, template string, query []byte) ([]byte, error) {
+	res, _, _, err := d.exchange(ctx, template, query)
+	return res, err
+}
+
+func (d *DoH) exchange(ctx context.Context, template string, query []byte) ([]byte, net.Addr, net.Addr, error) {
+	if len(query) < headerLen {
+		return nil, nil, nil, errFormat
+	}
+	// id 0 делает ответ кэшируемым для http кэшей
+	originalId := binary.BigEndian.Uint16(query)
+	query = append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(query, 0)
+
+	var req *http.Request
+	var err error
+	if d.method == http.MethodGet {
+		url := expandDoHTemplate(template, base64.RawURLEncoding.EncodeToString(query))
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, expandDoHTemplate(template, ""), bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+	var local, remote net.Addr
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	}))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, nil, fmt.Errorf("DoH server returned %v", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, dohMediaType) {
+		return nil, nil, nil, fmt.Errorf("DoH server returned content type %q", contentType)
+	}
+	res, err := io.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(res) < headerLen {
+		return nil, nil, nil, errors.New("too short DoH response")
+	}
+	if binary.BigEndian.Uint16(res) == 0 {
+		binary.BigEndian.PutUint16(res, originalId)
+	}
+	return res, local, remote, nil
+}
+
+// expandDoHTemplate раскрывает переменную dns шаблона rfc6570 в формах {?dns} и {&dns}.
+// пустое значение убирает переменную, для POST
+func expandDoHTemplate(template, dns string) string {
+	for _, form := range []string{"{?dns}", "{&dns}"} {
+		if strings.Contains(template, form) {
+			if dns == "" {
+				return strings.Replace(template, form, "", 1)
+			}
+			return strings.Replace(template, form, form[1:2]+"dns="+dns, 1)
+		}
+	}
+	if dns == "" {
+		return template
+	}
+	if strings.Contains(template, "?") {
+		return template + "&dns=" + dns
+	}
+	return template + "?dns=" + dns
+}
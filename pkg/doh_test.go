@@ -0,0 +1,177 @@
+package awesomedns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// dohRequest запрос, который получила заглушка DoH
+type dohRequest struct {
+	method      string
+	proto       string
+	contentType string
+	accept      string
+	id          uint16
+}
+
+// fakeDoHServer заглушка DoH с HTTP/2. handler может подменить ответ
+func fakeDoHServer(t *testing.T, handler func(w http.ResponseWriter, q []byte) bool) (*httptest.Server, chan dohRequest) {
+	t.Helper()
+	requests := make(chan dohRequest, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q []byte
+		var err error
+		if r.Method == http.MethodGet {
+			q, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			q, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(q) < headerLen {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		requests <- dohRequest{r.Method, r.Proto, r.Header.Get("Content-Type"), r.Header.Get("Accept"), binary.BigEndian.Uint16(q)}
+		if handler != nil && handler(w, q) {
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.80"}}, nil))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestDoHMethods(t *testing.T) {
+	server, requests := fakeDoHServer(t, nil)
+	tests := []struct {
+		method      string
+		template    string
+		contentType string
+	}{
+		{http.MethodGet, "/dns-query{?dns}", ""},
+		{http.MethodGet, "/dns-query?ct{&dns}", ""},
+		{http.MethodGet, "/dns-query", ""},
+		{http.MethodPost, "/dns-query{?dns}", dohMediaType},
+		{"", "/dns-query", dohMediaType},
+	}
+	for _, tt := range tests {
+		doh, err := NewDoH(DoHConfig{URL: server.URL + tt.template, Method: tt.method, Client: server.Client()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips, err := ResolveA("example.com", Config{HTTPS: doh})
+		if err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.80" {
+			t.Errorf("%v %v: ResolveA = %v, %v", tt.method, tt.template, ips, err)
+			continue
+		}
+		req := <-requests
+		wantMethod := tt.method
+		if wantMethod == "" {
+			wantMethod = http.MethodPost
+		}
+		if req.method != wantMethod || req.proto != "HTTP/2.0" || req.contentType != tt.contentType ||
+			req.accept != dohMediaType || req.id != 0 {
+			t.Errorf("%v %v: request %+v", tt.method, tt.template, req)
+		}
+	}
+}
+
+func TestDoHErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, q []byte) bool
+	}{
+		{"status", func(w http.ResponseWriter, q []byte) bool {
+			http.Error(w, "no", http.StatusInternalServerError)
+			return true
+		}},
+		{"content type", func(w http.ResponseWriter, q []byte) bool {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(testResponse(t, q, 0, nil, nil))
+			return true
+		}},
+		{"short response", func(w http.ResponseWriter, q []byte) bool {
+			w.Header().Set("Content-Type", dohMediaType)
+			w.Write(q[:4])
+			return true
+		}},
+	}
+	for _, tt := range tests {
+		server, _ := fakeDoHServer(t, tt.handler)
+		doh, err := NewDoH(DoHConfig{URL: server.URL + "/dns-query", Client: server.Client()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ips, err := ResolveA("example.com", Config{HTTPS: doh}); err == nil {
+			t.Errorf("%v: ResolveA succeeded with %v", tt.name, ips)
+		}
+	}
+}
+
+func TestNewDoHConfig(t *testing.T) {
+	tests := []struct {
+		config DoHConfig
+		ok     bool
+	}{
+		{DoHConfig{URL: "https://dns.example/dns-query{?dns}"}, true},
+		{DoHConfig{URL: "https://dns.example/dns-query", Method: http.MethodGet}, true},
+		{DoHConfig{URL: "dns.example/dns-query"}, false},
+		{DoHConfig{URL: "https://dns.example/dns-query", Method: http.MethodPut}, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewDoH(tt.config); (err == nil) != tt.ok {
+			t.Errorf("NewDoH(%+v) err = %v", tt.config, err)
+		}
+	}
+}
+
+func TestExpandDoHTemplate(t *testing.T) {
+	tests := []struct {
+		template, dns, want string
+	}{
+		{"https://d/q{?dns}", "AAAB", "https://d/q?dns=AAAB"},
+		{"https://d/q{?dns}", "", "https://d/q"},
+		{"https://d/q?ct{&dns}", "AAAB", "https://d/q?ct&dns=AAAB"},
+		{"https://d/q", "AAAB", "https://d/q?dns=AAAB"},
+		{"https://d/q?x=1", "AAAB", "https://d/q?x=1&dns=AAAB"},
+		{"https://d/q", "", "https://d/q"},
+	}
+	for _, tt := range tests {
+		if got := expandDoHTemplate(tt.template, tt.dns); got != tt.want {
+			t.Errorf("expandDoHTemplate(%q, %q) = %q, want %q", tt.template, tt.dns, got, tt.want)
+		}
+	}
+}
+
+func TestDoHDnstapProtocol(t *testing.T) {
+	server, _ := fakeDoHServer(t, nil)
+	doh, err := NewDoH(DoHConfig{URL: server.URL + "/dns-query", Client: server.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	dw, err := NewDnstapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveA("example.com", Config{HTTPS: doh, Dnstap: dw}); err != nil {
+		t.Fatal(err)
+	}
+	readFstrmFrame(&buf)
+	for _, typ := range []int{dnstapToolQuery, dnstapToolResponse} {
+		frame, err := readFstrmFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := dnstapMessage(t, frame); m[1] != uint64(typ) || m[3] != uint64(dnstapProtocolDOH) {
+			t.Errorf("type %v: %v", typ, m)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package awesomedns
+
+// DNS-over-TLS (rfc7858). соединения переиспользуются через TCPPool,
+// tls сессии возобновляются из общего кэша
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+)
+
+const dotPort = "853"
+
+var errPinMismatch = errors.New("server certificate does not match any SPKI pin")
+
+type DoTConfig struct {
+	// имя для проверки сертификата. по умолчанию хост из адреса сервера
+	ServerName string
+	// base64 от sha256 SubjectPublicKeyInfo (rfc7469). без ServerName проверяется только пин
+	SPKIPins []string
+	RootCAs  *x509.CertPool
+}
+
+// DoT транспорт для Config.TLS. один на все запросы, чтобы работали переиспользование
+// соединений и возобновление сессий
+type DoT struct {
+	tlsConfig *tls.Config
+	pool      *TCPPool
+}
+
+func NewDoT(config DoTConfig) (*DoT, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		RootCAs:            config.RootCAs,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(64),
+	}
+	if len(config.SPKIPins) > 0 {
+		var pins [][]byte
+		for _, pin := range config.SPKIPins {
+			sum, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil {
+				return nil, err
+			}
+			if len(sum) != sha256.Size {
+				return nil, errors.New("wrong SPKI pin length")
+			}
+			pins = append(pins, sum)
+		}
+		if config.ServerName == "" {
+			// цепочка не проверяется, доверие только по пину
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if string(sum[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+			return errPinMismatch
+		}
+	}
+	return &DoT{tlsConfig: tlsConfig, pool: NewTCPPool()}, nil
+}
+
+// SPKIPin считает пин для сертификата в формате DoTConfig.SPKIPins
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dial tls соединения с LocalAddr и BindDevice из config
+func (d *DoT) dial(config Config) dialFunc {
+	return func(ctx context.Context, server string) (net.Conn, error) {
+		netDialer, err := config.dialer("tcp")
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := d.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(server)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerName = host
+		}
+		dialer := tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		return dialer.DialContext(ctx, "tcp", server)
+	}
+}
+
+func (d *DoT) Close() error {
+	return d.pool.Close()
+}
+
+// dotServer добавляет порт 853, если он не указан
+func dotServer(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, dotPort)
+	}
+	return server
+}
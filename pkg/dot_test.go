@@ -0,0 +1,177 @@
+package awesomedns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// selfSigned сертификат для dns.test и 127.0.0.1
+func selfSigned(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+type dotStats struct {
+	handshakes atomic.Int32
+	resumed    atomic.Int32
+}
+
+// fakeDoTServer заглушка DoT на локальном адресе
+func fakeDoTServer(t *testing.T, cert tls.Certificate) (string, *dotStats) {
+	t.Helper()
+	stats := &dotStats{}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			stats.handshakes.Add(1)
+			if state.DidResume {
+				stats.resumed.Add(1)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, l, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.53"}}, nil)
+	})
+	return l.Addr().String(), stats
+}
+
+func TestDoTVerification(t *testing.T) {
+	cert, x509Cert := selfSigned(t)
+	server, _ := fakeDoTServer(t, cert)
+	roots := x509.NewCertPool()
+	roots.AddCert(x509Cert)
+	otherCert, _ := selfSigned(t)
+	otherX509, _ := x509.ParseCertificate(otherCert.Certificate[0])
+
+	tests := []struct {
+		name   string
+		config DoTConfig
+		ok     bool
+	}{
+		{"trusted root and server name", DoTConfig{ServerName: "dns.test", RootCAs: roots}, true},
+		{"trusted root, name from address", DoTConfig{RootCAs: roots}, true},
+		{"wrong server name", DoTConfig{ServerName: "other.test", RootCAs: roots}, false},
+		{"untrusted root", DoTConfig{ServerName: "dns.test"}, false},
+		{"pin only", DoTConfig{SPKIPins: []string{SPKIPin(x509Cert)}}, true},
+		{"wrong pin", DoTConfig{SPKIPins: []string{SPKIPin(otherX509)}}, false},
+		{"trusted root and wrong pin", DoTConfig{ServerName: "dns.test", RootCAs: roots, SPKIPins: []string{SPKIPin(otherX509)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dot, err := NewDoT(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dot.Close()
+			ips, err := ResolveA("example.com", Config{Server: server, TLS: dot, TCPTimeout: 5 * time.Second})
+			if tt.ok && (err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.53") {
+				t.Errorf("ResolveA = %v, %v", ips, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("ResolveA succeeded with %v", ips)
+			}
+		})
+	}
+}
+
+func TestDoTBadPin(t *testing.T) {
+	for _, pin := range []string{"not base64!", "AAAA"} {
+		if _, err := NewDoT(DoTConfig{SPKIPins: []string{pin}}); err == nil {
+			t.Errorf("NewDoT accepted pin %q", pin)
+		}
+	}
+}
+
+func TestDoTReuseAndResumption(t *testing.T) {
+	cert, x509Cert := selfSigned(t)
+	server, stats := fakeDoTServer(t, cert)
+	roots := x509.NewCertPool()
+	roots.AddCert(x509Cert)
+	dot, err := NewDoT(DoTConfig{ServerName: "dns.test", RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	config := Config{Server: server, TLS: dot}
+
+	for i := 0; i < 3; i++ {
+		if _, err := ResolveA("example.com", config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stats.handshakes.Load(); n != 1 {
+		t.Fatalf("%v handshakes for 3 queries, want 1", n)
+	}
+
+	// после закрытия соединения сессия возобновляется
+	dot.pool.Close()
+	dot.pool = NewTCPPool()
+	if _, err := ResolveA("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	if stats.handshakes.Load() != 2 || stats.resumed.Load() != 1 {
+		t.Errorf("handshakes %v, resumed %v", stats.handshakes.Load(), stats.resumed.Load())
+	}
+}
+
+func TestDoTDnstapProtocol(t *testing.T) {
+	cert, x509Cert := selfSigned(t)
+	server, _ := fakeDoTServer(t, cert)
+	dot, err := NewDoT(DoTConfig{SPKIPins: []string{SPKIPin(x509Cert)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	var buf bytes.Buffer
+	dw, err := NewDnstapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveA("example.com", Config{Server: server, TLS: dot, Dnstap: dw}); err != nil {
+		t.Fatal(err)
+	}
+	readFstrmFrame(&buf)
+	for _, typ := range []int{dnstapToolQuery, dnstapToolResponse} {
+		frame, err := readFstrmFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := dnstapMessage(t, frame); m[1] != uint64(typ) || m[3] != uint64(dnstapProtocolDOT) {
+			t.Errorf("type %v: %v", typ, m)
+		}
+	}
+}
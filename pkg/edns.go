@@ -0,0 +1,146 @@
+package awesomedns
+
+// EDNS(0) по rfc6891. в OPT записи класс - размер udp буфера, ttl - расширенный код ошибки и флаги
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	EdnsTCPKeepalive = 11 // rfc7828
+
+	defaultEdnsUDPSize = 1232
+)
+
+type EdnsOption struct {
+	Code uint16
+	Data []byte
+}
+
+// DnsOpt данные OPT записи
+type DnsOpt struct {
+	Options []EdnsOption
+}
+
+func parseOpt(rdata []byte) (DnsOpt, error) {
+	var res DnsOpt
+	for len(rdata) > 0 {
+		if len(rdata) < 4 {
+			return res, errFormat
+		}
+		code := binary.BigEndian.Uint16(rdata)
+		length := int(binary.BigEndian.Uint16(rdata[2:]))
+		if 4+length > len(rdata) {
+			return res, errFormat
+		}
+		res.Options = append(res.Options, EdnsOption{code, rdata[4 : 4+length]})
+		rdata = rdata[4+length:]
+	}
+	return res, nil
+}
+
+// appendOpt добавляет OPT запись в конец запроса. запрос не должен уже содержать OPT
+func appendOpt(query []byte, udpSize uint16, options ...EdnsOption) []byte {
+	res := make([]byte, len(query), len(query)+11)
+	copy(res, query)
+	binary.BigEndian.PutUint16(res[10:], binary.BigEndian.Uint16(res[10:])+1)
+	res = append(res, 0) // корень
+	res = binary.BigEndian.AppendUint16(res, uint16(RR_OPT))
+	res = binary.BigEndian.AppendUint16(res, udpSize)
+	res = binary.BigEndian.AppendUint32(res, 0)
+	var rdata []byte
+	for _, option := range options {
+		rdata = binary.BigEndian.AppendUint16(rdata, option.Code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(option.Data)))
+		rdata = append(rdata, option.Data...)
+	}
+	res = binary.BigEndian.AppendUint16(res, uint16(len(rdata)))
+	return append(res, rdata...)
+}
+
+// addOption копия сообщения с опцией в его OPT записи, если опции с таким кодом там
+// еще нет. false если OPT записи нет или сообщение не разобрать
+func addOption(msg []byte, option EdnsOption) ([]byte, bool) {
+	header, err := parseDnsHeader(msg)
+	if err != nil {
+		return msg, false
+	}
+	nameCache := map[int]string{}
+	pos := headerLen
+	for i := 0; i < int(header.QDCount); i++ {
+		_, read, err := readName(msg[pos:], nameCache, pos)
+		if err != nil || pos+read+4 > len(msg) {
+			return msg, false
+		}
+		pos += read + 4
+	}
+	records := int(header.ANCount) + int(header.NSCount) + int(header.ARCount)
+	for i := 0; i < records; i++ {
+		_, read, err := readName(msg[pos:], nameCache, pos)
+		if err != nil || pos+read+10 > len(msg) {
+			return msg, false
+		}
+		pos += read
+		typ := binary.BigEndian.Uint16(msg[pos:])
+		rdlength := int(binary.BigEndian.Uint16(msg[pos+8:]))
+		end := pos + 10 + rdlength
+		if end > len(msg) {
+			return msg, false
+		}
+		if DnsType(typ) != RR_OPT {
+			pos = end
+			continue
+		}
+		opt, err := parseOpt(msg[pos+10 : end])
+		if err != nil {
+			return msg, false
+		}
+		for _, o := range opt.Options {
+			if o.Code == option.Code {
+				return append([]byte(nil), msg...), true
+			}
+		}
+		res := make([]byte, 0, len(msg)+4+len(option.Data))
+		res = append(res, msg[:end]...)
+		res = binary.BigEndian.AppendUint16(res, option.Code)
+		res = binary.BigEndian.AppendUint16(res, uint16(len(option.Data)))
+		res = append(res, option.Data...)
+		res = append(res, msg[end:]...)
+		binary.BigEndian.PutUint16(res[pos+8:], uint16(rdlength+4+len(option.Data)))
+		return res, true
+	}
+	return msg, false
+}
+
+// hasAdditional true если в сообщении уже есть дополнительные записи
+func hasAdditional(msg []byte) bool {
+	return len(msg) >= headerLen && binary.BigEndian.Uint16(msg[10:]) > 0
+}
+
+// responseOpt ищет OPT запись в ответе
+func responseOpt(response []byte) (DnsOpt, bool) {
+	msg, err := ParseMessage(response)
+	if err != nil {
+		return DnsOpt{}, false
+	}
+	for _, rr := range msg.Additional {
+		if opt, ok := rr.Data.(DnsOpt); ok {
+			return opt, true
+		}
+	}
+	return DnsOpt{}, false
+}
+
+// tcpKeepalive таймаут простоя, который сервер объявил в edns-tcp-keepalive
+func tcpKeepalive(response []byte) (time.Duration, bool) {
+	opt, ok := responseOpt(response)
+	if !ok {
+		return 0, false
+	}
+	for _, option := range opt.Options {
+		if option.Code == EdnsTCPKeepalive && len(option.Data) == 2 {
+			return time.Duration(binary.BigEndian.Uint16(option.Data)) * 100 * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,168 @@
+package awesomedns
+
+// общие заглушки серверов для тестов
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testRR запись для ответа заглушки. data - адрес для A и AAAA, текст для TXT,
+// "10 mx.example" для MX, "10 5 5060 sip.example" для SRV, имя для остальных типов
+type testRR struct {
+	name string
+	typ  DnsType
+	ttl  uint32
+	data string
+}
+
+// testResponse ответ на запрос q с заданным кодом и записями по секциям
+func testResponse(t *testing.T, q []byte, rcode byte, answer, authority []testRR) []byte {
+	t.Helper()
+	res := append([]byte(nil), q[:headerLen]...)
+	res[2] |= 0b1000_0000
+	res[3] = 0b1000_0000 | rcode
+	binary.BigEndian.PutUint16(res[6:], uint16(len(answer)))
+	binary.BigEndian.PutUint16(res[8:], uint16(len(authority)))
+	binary.BigEndian.PutUint16(res[10:], 0)
+	res = append(res, q[headerLen:questionEnd(t, q)]...)
+	for _, rr := range append(answer, authority...) {
+		res = appendTestRR(t, res, rr)
+	}
+	return res
+}
+
+// questionEnd конец секции question, OPT запроса в ответ не попадает
+func questionEnd(t *testing.T, q []byte) int {
+	t.Helper()
+	_, read, err := readName(q[headerLen:], map[int]string{}, headerLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return headerLen + read + 4
+}
+
+func appendTestRR(t *testing.T, b []byte, rr testRR) []byte {
+	t.Helper()
+	owner, err := encodeName(rr.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, owner...)
+	b = binary.BigEndian.AppendUint16(b, uint16(rr.typ))
+	b = binary.BigEndian.AppendUint16(b, uint16(ClassIN))
+	b = binary.BigEndian.AppendUint32(b, rr.ttl)
+	var rdata []byte
+	switch rr.typ {
+	case RR_A:
+		rdata = net.ParseIP(rr.data).To4()
+	case RR_AAAA:
+		rdata = net.ParseIP(rr.data).To16()
+	case RR_TXT:
+		rdata = append([]byte{byte(len(rr.data))}, rr.data...)
+	case RR_MX, RR_SRV:
+		// "предпочтение имя" и "приоритет вес порт имя"
+		fields := strings.Fields(rr.data)
+		for _, field := range fields[:len(fields)-1] {
+			n, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdata = binary.BigEndian.AppendUint16(rdata, uint16(n))
+		}
+		target, err := encodeName(fields[len(fields)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdata = append(rdata, target...)
+	case RR_SOA:
+		mname, _ := encodeName("ns." + rr.name)
+		rname, _ := encodeName("hostmaster." + rr.name)
+		rdata = append(mname, rname...)
+		// serial, refresh, retry, expire, minimum
+		for _, n := range []uint32{1, 7200, 3600, 1209600, 60} {
+			rdata = binary.BigEndian.AppendUint32(rdata, n)
+		}
+	default:
+		if rdata, err = encodeName(rr.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// udpServer заглушка сервера на udp. handler возвращает ответ или nil, чтобы промолчать
+func udpServer(t *testing.T, handler func(q []byte) []byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveUDP(t, pc, handler)
+	return pc.LocalAddr().String()
+}
+
+// serveUDP отвечает на запросы, пришедшие в pc
+func serveUDP(t *testing.T, pc net.PacketConn, handler func(q []byte) []byte) {
+	t.Helper()
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if res := handler(append([]byte(nil), buf[:n]...)); res != nil {
+				pc.WriteTo(res, addr)
+			}
+		}
+	}()
+}
+
+// serveTCP отвечает на запросы из соединений l по одному, с двухбайтовой длиной
+func serveTCP(t *testing.T, l net.Listener, handler func(q []byte) []byte) {
+	t.Helper()
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				size := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(size))
+					if _, err := io.ReadFull(conn, q); err != nil {
+						return
+					}
+					res := handler(q)
+					frame := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+					if _, err := conn.Write(append(frame, res...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// tcpServer заглушка сервера на tcp
+func tcpServer(t *testing.T, handler func(q []byte) []byte) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, l, handler)
+	return l.Addr().String()
+}
@@ -0,0 +1,162 @@
+package awesomedns
+
+// статические записи из hosts(5). файл перечитывается при изменении,
+// проверка не чаще hostsCheckInterval
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultHostsFile = "/etc/hosts"
+
+const hostsCheckInterval = 5 * time.Second
+
+// HostsOrder порядок источников, как строка hosts в nsswitch.conf
+type HostsOrder int
+
+const (
+	HostsFirst HostsOrder = iota // files dns
+	HostsLast                    // dns files
+	HostsOnly                    // files
+)
+
+// Hosts источник для Config.Hosts. безопасен для одновременного использования
+type Hosts struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	byName  map[string][]net.IP
+	byAddr  map[string][]string
+}
+
+// NewHosts файл читается при первом запросе. пустой path - DefaultHostsFile
+func NewHosts(path string) *Hosts {
+	if path == "" {
+		path = DefaultHostsFile
+	}
+	return &Hosts{path: path}
+}
+
+// LookupHost адреса для имени, регистр не важен
+func (h *Hosts) LookupHost(name string) []net.IP {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update()
+	return h.byName[hostsKey(name)]
+}
+
+// LookupAddr имена для адреса, первое - каноническое
+func (h *Hosts) LookupAddr(ip net.IP) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update()
+	return h.byAddr[ip.String()]
+}
+
+func (h *Hosts) update() {
+	now := time.Now()
+	if !h.checked.IsZero() && now.Sub(h.checked) < hostsCheckInterval {
+		return
+	}
+	h.checked = now
+	st, err := os.Stat(h.path)
+	if err != nil {
+		// файла нет, записей тоже
+		h.byName, h.byAddr = nil, nil
+		h.modTime, h.size = time.Time{}, 0
+		return
+	}
+	if h.byName != nil && st.ModTime().Equal(h.modTime) && st.Size() == h.size {
+		return
+	}
+	byName, byAddr, err := readHosts(h.path)
+	if err != nil {
+		return
+	}
+	h.byName, h.byAddr = byName, byAddr
+	h.modTime, h.size = st.ModTime(), st.Size()
+}
+
+func readHosts(path string) (map[string][]net.IP, map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	byName := map[string][]net.IP{}
+	byAddr := map[string][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// зона у ipv6 не нужна для запросов
+		host, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, name := range fields[1:] {
+			key := hostsKey(name)
+			byName[key] = append(byName[key], ip)
+			byAddr[ip.String()] = append(byAddr[ip.String()], strings.TrimSuffix(name, "."))
+		}
+	}
+	return byName, byAddr, scanner.Err()
+}
+
+func hostsKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// withHosts объединяет hosts и dns в порядке config.HostsOrder.
+// следующий источник опрашивается, если предыдущий ничего не нашел
+func withHosts[T any](config Config, files func() []T, dns func() ([]T, error)) ([]T, error) {
+	if config.Hosts == nil {
+		return dns()
+	}
+	switch config.HostsOrder {
+	case HostsOnly:
+		if res := files(); len(res) > 0 {
+			return res, nil
+		}
+		return nil, errNameError
+	case HostsLast:
+		res, err := dns()
+		if err == nil && len(res) > 0 {
+			return res, nil
+		}
+		if fromFiles := files(); len(fromFiles) > 0 {
+			return fromFiles, nil
+		}
+		return res, err
+	default:
+		if res := files(); len(res) > 0 {
+			return res, nil
+		}
+		return dns()
+	}
+}
+
+// hostsIPs адреса из hosts нужного семейства
+func hostsIPs(hosts *Hosts, qname string, v4 bool) []net.IP {
+	var res []net.IP
+	for _, ip := range hosts.LookupHost(qname) {
+		if (ip.To4() != nil) == v4 {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
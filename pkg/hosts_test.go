@@ -0,0 +1,187 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostsFile(t *testing.T) {
+	hosts := NewHosts(filepath.Join("testdata", "hosts"))
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"db01", []string{"192.0.2.10", "2001:db8::10"}},
+		{"DB01.example.", []string{"192.0.2.10", "2001:db8::10"}},
+		{"web.example", []string{"192.0.2.11"}},
+		{"web", []string{"192.0.2.11"}},
+		{"link.example", []string{"fe80::1"}},
+		{"broken.example", nil},
+		{"missing.example", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, ip := range hosts.LookupHost(tt.name) {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupHost(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := hosts.LookupAddr(net.ParseIP("192.0.2.11")); !reflect.DeepEqual(got, []string{"web.example", "WEB"}) {
+		t.Errorf("LookupAddr = %v", got)
+	}
+}
+
+// hostsTestServer отвечает только на db01 и other.example, остальным NXDOMAIN
+func hostsTestServer(t *testing.T) (string, *atomic.Int32) {
+	var queries atomic.Int32
+	server := udpServer(t, func(q []byte) []byte {
+		queries.Add(1)
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil
+		}
+		question := msg.Question[0]
+		if question.Name != "db01" && question.Name != "other.example" {
+			return testResponse(t, q, 3, nil, nil)
+		}
+		data := "198.51.100.1"
+		if question.Type == RR_AAAA {
+			data = "2001:db8::53"
+		}
+		return testResponse(t, q, 0, []testRR{{question.Name, question.Type, 60, data}}, nil)
+	})
+	return server, &queries
+}
+
+func TestHostsOrder(t *testing.T) {
+	server, queries := hostsTestServer(t)
+	hosts := NewHosts(filepath.Join("testdata", "hosts"))
+	tests := []struct {
+		hosts *Hosts
+		order HostsOrder
+		typ   DnsType
+		qname string
+		want  []string
+		err   error
+		dns   int32 // число запросов к серверу
+	}{
+		{nil, HostsFirst, RR_A, "db01", []string{"198.51.100.1"}, nil, 1},
+		{hosts, HostsFirst, RR_A, "db01", []string{"192.0.2.10"}, nil, 0},
+		{hosts, HostsFirst, RR_AAAA, "db01", []string{"2001:db8::10"}, nil, 0},
+		{hosts, HostsFirst, RR_A, "other.example", []string{"198.51.100.1"}, nil, 1},
+		// адреса другого семейства в hosts не мешают спросить dns
+		{hosts, HostsFirst, RR_AAAA, "web.example", nil, errNameError, 1},
+		{hosts, HostsLast, RR_A, "db01", []string{"198.51.100.1"}, nil, 1},
+		{hosts, HostsLast, RR_A, "web.example", []string{"192.0.2.11"}, nil, 1},
+		{hosts, HostsLast, RR_A, "missing.example", nil, errNameError, 1},
+		{hosts, HostsOnly, RR_A, "db01", []string{"192.0.2.10"}, nil, 0},
+		{hosts, HostsOnly, RR_A, "other.example", nil, errNameError, 0},
+	}
+	for _, tt := range tests {
+		queries.Store(0)
+		r := NewResolver(Config{Server: server, Hosts: tt.hosts, HostsOrder: tt.order})
+		var ips []net.IP
+		var err error
+		if tt.typ == RR_A {
+			ips, err = r.ResolveA(context.Background(), tt.qname)
+		} else {
+			ips, err = r.ResolveAaaa(context.Background(), tt.qname)
+		}
+		name := fmt.Sprintf("hosts %v, order %v, %v %v", tt.hosts != nil, tt.order, RRnames[tt.typ], tt.qname)
+		if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%v: err = %v, want %v", name, err, tt.err)
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: %v, want %v", name, got, tt.want)
+		}
+		if n := queries.Load(); n != tt.dns {
+			t.Errorf("%v: %v dns queries, want %v", name, n, tt.dns)
+		}
+	}
+}
+
+func TestHostsReverse(t *testing.T) {
+	server, queries := hostsTestServer(t)
+	hosts := NewHosts(filepath.Join("testdata", "hosts"))
+	tests := []struct {
+		order HostsOrder
+		addr  string
+		want  []string
+		err   error
+	}{
+		{HostsFirst, "192.0.2.10", []string{"db01.example", "db01"}, nil},
+		{HostsFirst, "2001:db8::10", []string{"db01.example", "db01"}, nil},
+		{HostsOnly, "127.0.0.1", []string{"localhost"}, nil},
+		{HostsOnly, "192.0.2.99", nil, errNameError},
+	}
+	for _, tt := range tests {
+		r := NewResolver(Config{Server: server, Hosts: hosts, HostsOrder: tt.order})
+		names, err := r.ResolvePtr(context.Background(), tt.addr)
+		if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%v: err = %v, want %v", tt.addr, err, tt.err)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%v: %v, want %v", tt.addr, names, tt.want)
+		}
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%v dns queries", n)
+	}
+}
+
+// файл перечитывается после изменения, но не чаще hostsCheckInterval
+func TestHostsReload(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, fixture, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hosts := NewHosts(path)
+	lookup := func() string {
+		return fmt.Sprint(hosts.LookupHost("db01"))
+	}
+	// checkedAgo сдвигает время последней проверки в прошлое
+	checkedAgo := func(d time.Duration) {
+		hosts.mu.Lock()
+		hosts.checked = time.Now().Add(-d)
+		hosts.mu.Unlock()
+	}
+	if got := lookup(); got != "[192.0.2.10 2001:db8::10]" {
+		t.Fatalf("initial %v", got)
+	}
+	if err := os.WriteFile(path, []byte("192.0.2.20 db01\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	checkedAgo(hostsCheckInterval - time.Second)
+	if got := lookup(); got != "[192.0.2.10 2001:db8::10]" {
+		t.Errorf("reread before interval: %v", got)
+	}
+	checkedAgo(hostsCheckInterval)
+	if got := lookup(); got != "[192.0.2.20]" {
+		t.Errorf("after change: %v", got)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	checkedAgo(hostsCheckInterval)
+	if got := lookup(); got != "[]" {
+		t.Errorf("after remove: %v", got)
+	}
+}
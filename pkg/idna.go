@@ -0,0 +1,68 @@
+package awesomedns
+
+// интернационализированные имена (IDNA2008 с отображением UTS-46).
+// в запрос имя уходит в punycode, в ответах по желанию переводится обратно
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ToASCII переводит имя в punycode. ascii имена не меняются и не проверяются
+func ToASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	return idna.Lookup.ToASCII(name)
+}
+
+// ToUnicode переводит punycode метки в unicode. при ошибке возвращает имя как есть
+func ToUnicode(name string) string {
+	if !strings.Contains(strings.ToLower(name), "xn--") {
+		return name
+	}
+	res, err := idna.Lookup.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return res
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// unicodeNames переводит в unicode имя записи и доменные имена в ее данных
+func (rr DnsRecord) unicodeNames() DnsRecord {
+	rr.Name = ToUnicode(rr.Name)
+	switch data := rr.Data.(type) {
+	case string:
+		switch rr.Type {
+		case RR_CNAME, RR_NS, RR_PTR, RR_AFSDB, RR_DNAME:
+			rr.Data = ToUnicode(data)
+		}
+	case DnsSoa:
+		data.Name = ToUnicode(data.Name)
+		data.Mname = ToUnicode(data.Mname)
+		rr.Data = data
+	case DnsMx:
+		data.Exchange = ToUnicode(data.Exchange)
+		rr.Data = data
+	case DnsSRV:
+		data.Target = ToUnicode(data.Target)
+		rr.Data = data
+	case DnsNaptr:
+		data.Replacement = ToUnicode(data.Replacement)
+		rr.Data = data
+	case DnsRp:
+		data.Mailbox = ToUnicode(data.Mailbox)
+		data.TXTRR = ToUnicode(data.TXTRR)
+		rr.Data = data
+	}
+	return rr
+}
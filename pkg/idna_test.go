@@ -0,0 +1,74 @@
+package awesomedns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "Example.COM", true},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai", true},
+		{"ПРИМЕР.рф", "xn--e1afmkfd.xn--p1ai", true},
+		{"Bücher.example", "xn--bcher-kva.example", true},
+		{"̀a.example", "", false},
+		{"-x.пример", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ToASCII(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ToASCII(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestToUnicode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"xn--e1afmkfd.xn--p1ai", "пример.рф"},
+		{"XN--E1AFMKFD.xn--p1ai", "пример.рф"},
+		{"mail.xn--bcher-kva.example", "mail.bücher.example"},
+		// неверный punycode остается как есть
+		{"xn--zz.example", "xn--zz.example"},
+	}
+	for _, tt := range tests {
+		if got := ToUnicode(tt.in); got != tt.want {
+			t.Errorf("ToUnicode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnicodeNamesInAnswers(t *testing.T) {
+	questions := make(chan string, 1)
+	server := udpServer(t, func(q []byte) []byte {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil
+		}
+		questions <- msg.Question[0].Name
+		return testResponse(t, q, 0, []testRR{{"xn--e1afmkfd.xn--p1ai", RR_CNAME, 60, "www.xn--bcher-kva.example"}}, nil)
+	})
+	tests := []struct {
+		unicode bool
+		want    []string
+	}{
+		{false, []string{"www.xn--bcher-kva.example"}},
+		{true, []string{"www.bücher.example"}},
+	}
+	for _, tt := range tests {
+		res, err := ResolveCname("пример.рф", Config{Server: server, UnicodeNames: tt.unicode})
+		if err != nil || !reflect.DeepEqual(res, tt.want) {
+			t.Errorf("UnicodeNames %v: %v, %v, want %v", tt.unicode, res, err, tt.want)
+		}
+		// в запрос имя уходит в punycode
+		if question := <-questions; question != "xn--e1afmkfd.xn--p1ai" {
+			t.Errorf("question %q", question)
+		}
+	}
+}
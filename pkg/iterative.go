@@ -0,0 +1,334 @@
+package awesomedns
+
+// итеративное разрешение: запросы без RD начиная с корневых серверов, переход
+// по делегированиям из authority с адресами из additional (glue). адреса NS без glue
+// разрешаются тем же способом, делегирования кэшируются по ttl записей NS
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxReferrals      = 30 // переходов по делегированиям для одного имени
+	maxIterativeDepth = 8  // вложенность разрешения имен NS без glue
+	maxMinimiseCount  = 10 // MAX_MINIMISE_COUNT из rfc9156
+	minimiseOneLab    = 4  // MINIMISE_ONE_LAB из rfc9156
+)
+
+var (
+	errTooManyReferrals = errors.New("too many referrals")
+	errIterativeDepth   = errors.New("too deep NS name resolution")
+	errLameDelegation   = errors.New("lame delegation")
+)
+
+// DefaultRootHints адреса корневых серверов a-m
+var DefaultRootHints = []string{
+	"198.41.0.4:53",
+	"170.247.170.2:53",
+	"192.33.4.12:53",
+	"199.7.91.13:53",
+	"192.203.230.10:53",
+	"192.5.5.241:53",
+	"192.112.36.4:53",
+	"198.97.190.53:53",
+	"192.36.148.17:53",
+	"192.58.128.30:53",
+	"193.0.14.129:53",
+	"199.7.83.42:53",
+	"202.12.27.33:53",
+}
+
+// Iterator итеративный резолвер для Config.Iterative. один на все запросы,
+// чтобы кэш делегирований был общим
+type Iterator struct {
+	// адреса корневых серверов "ip:port", по умолчанию DefaultRootHints
+	RootHints []string
+	// порт для адресов из делегирований, по умолчанию 53
+	Port string
+	// QNAME minimisation (rfc9156): серверам зон показывается на одну метку больше
+	// их зоны и тип A вместо настоящего. на NXDOMAIN и отказ сервера дальше
+	// спрашивается полное имя
+	Minimise bool
+
+	mu          sync.Mutex
+	delegations map[string]delegation
+}
+
+// delegation серверы зоны
+type delegation struct {
+	zone    Name
+	servers []string
+	expire  time.Time
+}
+
+func NewIterator() *Iterator {
+	return &Iterator{delegations: map[string]delegation{}}
+}
+
+// lookup доходит по делегированиям до сервера, который отвечает на запрос сам
+func (it *Iterator) lookup(ctx context.Context, rrtype DnsType, qname string, config Config, depth int) ([]byte, error) {
+	if depth > maxIterativeDepth {
+		return nil, errIterativeDepth
+	}
+	qname, err := ToASCII(qname)
+	if err != nil {
+		return nil, err
+	}
+	name, err := ParseName(qname)
+	if err != nil {
+		return nil, err
+	}
+	d := it.closest(name)
+	minimise := it.Minimise
+	known, step := d.zone.NumLabels(), 0
+	for i := 0; i < maxReferrals+maxMinimiseCount; i++ {
+		sname, stype, minimised := name, rrtype, false
+		if minimise {
+			if n := minimiseLabels(known, name.NumLabels(), step); n < name.NumLabels() {
+				sname, stype, minimised = name.Ancestors()[name.NumLabels()-n], RR_A, true
+				step++
+			}
+		}
+		response, msg, err := it.ask(ctx, d, stype, sname.String(), config)
+		if minimised && (err != nil || msg.Header.RCode == 3) && ctx.Err() == nil {
+			// сломанные серверы отвечают NXDOMAIN на пустые нетерминалы, дальше без минимизации
+			if err == nil {
+				err = errNameError
+			}
+			config.logger().Debug("qname minimisation failed", "qname", qname, "at", sname, "err", err)
+			minimise = false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		child, nsNames, ttl, ok := referral(msg, d.zone, sname)
+		if !ok {
+			if minimised {
+				// не граница зоны, добавляем метки у того же сервера
+				known = sname.NumLabels()
+				continue
+			}
+			return response, nil
+		}
+		next := delegation{zone: child, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+		next.servers = it.glue(msg, d.zone, nsNames)
+		if len(next.servers) == 0 {
+			next.servers = it.resolveNs(ctx, nsNames, config, depth)
+		}
+		if len(next.servers) == 0 {
+			return nil, errLameDelegation
+		}
+		it.store(next)
+		d = next
+		known = child.NumLabels()
+	}
+	return nil, errTooManyReferrals
+}
+
+// minimiseLabels число меток в имени на очередном шаге минимизации (rfc9156 2.3):
+// первые minimiseOneLab шагов по одной метке, дальше оставшиеся метки делятся
+// на оставшиеся шаги, чтобы длинные имена вроде ip6.arpa не требовали десятков запросов
+func minimiseLabels(known, total, step int) int {
+	if step < minimiseOneLab {
+		return min(known+1, total)
+	}
+	left := maxMinimiseCount - step
+	if left <= 1 {
+		return total
+	}
+	return min(known+max((total-known)/left, 1), total)
+}
+
+// ask опрашивает серверы зоны по очереди, пока один не даст годный ответ
+func (it *Iterator) ask(ctx context.Context, d delegation, rrtype DnsType, qname string, config Config) ([]byte, DnsMessage, error) {
+	var lastErr error = errNoServers
+	for _, server := range d.servers {
+		response, msg, err := it.exchange(ctx, server, rrtype, qname, config)
+		if err == nil {
+			if err = rcodeError(msg.Header.RCode); errors.Is(err, errNameError) {
+				err = nil
+			}
+		}
+		if err == nil && isLame(msg, d.zone) {
+			err = errLameDelegation
+		}
+		if err == nil {
+			return response, msg, nil
+		}
+		if ctx.Err() != nil {
+			return nil, msg, ctx.Err()
+		}
+		config.logger().Warn("server failed", "server", server, "zone", d.zone, "err", err)
+		lastErr = err
+	}
+	return nil, DnsMessage{}, lastErr
+}
+
+// exchange один запрос без RD
+func (it *Iterator) exchange(ctx context.Context, server string, rrtype DnsType, qname string, config Config) ([]byte, DnsMessage, error) {
+	q, err := newQuery(rrtype, qname, config)
+	if err != nil {
+		return nil, DnsMessage{}, err
+	}
+	q[2] &^= 0b1
+	// авторитетные серверы отвечают только по обычному dns на порт 53
+	config.Transport, config.TLS, config.HTTPS = nil, nil, nil
+	response, err := exchangeServer(ctx, config.wrapTransport(server, NewServerTransport(server, config)), q, config)
+	if err != nil {
+		return nil, DnsMessage{}, err
+	}
+	msg, err := ParseMessage(response)
+	return response, msg, err
+}
+
+// referral зона ниже текущей, на которую ссылается ответ, и имена ее серверов
+func referral(msg DnsMessage, zone, name Name) (Name, []Name, uint32, bool) {
+	var child Name
+	var nsNames []Name
+	var ttl uint32
+	if msg.Header.RCode != 0 || len(msg.Answer) > 0 {
+		return child, nil, 0, false
+	}
+	for _, rr := range msg.Authority {
+		if rr.Type != RR_NS {
+			continue
+		}
+		owner, err := ParseName(rr.Name)
+		if err != nil || owner.Equal(zone) || !owner.IsSubdomain(zone) || !name.IsSubdomain(owner) {
+			continue
+		}
+		if len(nsNames) > 0 && !owner.Equal(child) {
+			continue
+		}
+		nsName, err := ParseName(rr.Data.(string))
+		if err != nil {
+			continue
+		}
+		if len(nsNames) == 0 || rr.Ttl < ttl {
+			ttl = rr.Ttl
+		}
+		child = owner
+		nsNames = append(nsNames, nsName)
+	}
+	return child, nsNames, ttl, len(nsNames) > 0
+}
+
+// isLame ответ без данных, который ссылается вверх, на зону выше опрашиваемой
+func isLame(msg DnsMessage, zone Name) bool {
+	if msg.Header.RCode != 0 || len(msg.Answer) > 0 {
+		return false
+	}
+	for _, rr := range msg.Authority {
+		if rr.Type == RR_SOA {
+			return false
+		}
+	}
+	for _, rr := range msg.Authority {
+		if rr.Type != RR_NS {
+			continue
+		}
+		if owner, err := ParseName(rr.Name); err == nil && !owner.IsSubdomain(zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// glue адреса серверов из additional. принимаются только адреса имен внутри зоны,
+// за которую отвечал сервер, остальным он не может быть источником
+func (it *Iterator) glue(msg DnsMessage, zone Name, nsNames []Name) []string {
+	var v4, v6 []string
+	for _, rr := range msg.Additional {
+		if rr.Type != RR_A && rr.Type != RR_AAAA {
+			continue
+		}
+		owner, err := ParseName(rr.Name)
+		if err != nil || !owner.IsSubdomain(zone) {
+			continue
+		}
+		for _, nsName := range nsNames {
+			if !owner.Equal(nsName) {
+				continue
+			}
+			addr := net.JoinHostPort(rr.Data.(net.IP).String(), it.port())
+			if rr.Type == RR_A {
+				v4 = append(v4, addr)
+			} else {
+				v6 = append(v6, addr)
+			}
+		}
+	}
+	return append(v4, v6...)
+}
+
+// resolveNs адреса серверов без glue. имена разрешаются по очереди до первого успешного,
+// AAAA спрашивается только если нет A
+func (it *Iterator) resolveNs(ctx context.Context, nsNames []Name, config Config, depth int) []string {
+	for _, nsName := range nsNames {
+		var res []string
+		for _, rrtype := range []DnsType{RR_A, RR_AAAA} {
+			if len(res) > 0 {
+				break
+			}
+			response, err := it.lookup(ctx, rrtype, nsName.String(), config, depth+1)
+			if err != nil {
+				config.logger().Warn("resolve NS failed", "ns", nsName, "err", err)
+				break
+			}
+			records, _, err := parseDnsAnswer(response, false)
+			if err != nil {
+				break
+			}
+			for _, record := range records {
+				if ip, ok := record.(net.IP); ok {
+					res = append(res, net.JoinHostPort(ip.String(), it.port()))
+				}
+			}
+		}
+		if len(res) > 0 {
+			return res
+		}
+	}
+	return nil
+}
+
+// closest ближайшее к имени известное делегирование, в крайнем случае корень
+func (it *Iterator) closest(name Name) delegation {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	now := time.Now()
+	for _, zone := range name.Ancestors() {
+		key := zone.Lower().String()
+		if d, ok := it.delegations[key]; ok {
+			if now.Before(d.expire) {
+				return d
+			}
+			delete(it.delegations, key)
+		}
+	}
+	hints := it.RootHints
+	if len(hints) == 0 {
+		hints = DefaultRootHints
+	}
+	return delegation{zone: RootName, servers: hints}
+}
+
+func (it *Iterator) store(d delegation) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.delegations == nil {
+		it.delegations = map[string]delegation{}
+	}
+	it.delegations[d.zone.Lower().String()] = d
+}
+
+func (it *Iterator) port() string {
+	if it.Port == "" {
+		return "53"
+	}
+	return it.Port
+}
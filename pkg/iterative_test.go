@@ -0,0 +1,251 @@
+package awesomedns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testZone записи одной зоны авторитетной заглушки. NS ниже origin - делегирования
+type testZone struct {
+	origin  string
+	records []testRR
+}
+
+func under(t *testing.T, name, zone string) bool {
+	t.Helper()
+	n, err := ParseName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := ParseName(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.IsSubdomain(z)
+}
+
+// authResponse ответ авторитетного сервера зон: делегирование с glue, данные,
+// NODATA или NXDOMAIN с SOA
+func authResponse(t *testing.T, q []byte, zones []testZone) []byte {
+	msg, err := ParseMessage(q)
+	if err != nil || len(msg.Question) != 1 {
+		return nil
+	}
+	qname, qtype := msg.Question[0].Name, msg.Question[0].Type
+	var zone *testZone
+	for i := range zones {
+		if under(t, qname, zones[i].origin) && (zone == nil || under(t, zones[i].origin, zone.origin)) {
+			zone = &zones[i]
+		}
+	}
+	if zone == nil {
+		return testResponse(t, q, 5, nil, nil)
+	}
+	var answer, authority, glue []testRR
+	for _, rr := range zone.records {
+		if rr.typ == RR_NS && !strings.EqualFold(rr.name, zone.origin) && under(t, qname, rr.name) {
+			authority = append(authority, rr)
+		}
+	}
+	if len(authority) > 0 {
+		for _, ns := range authority {
+			for _, rr := range zone.records {
+				if (rr.typ == RR_A || rr.typ == RR_AAAA) && strings.EqualFold(rr.name, ns.data) {
+					glue = append(glue, rr)
+				}
+			}
+		}
+		res := testResponse(t, q, 0, nil, authority)
+		for _, rr := range glue {
+			res = appendTestRR(t, res, rr)
+		}
+		binary.BigEndian.PutUint16(res[10:], uint16(len(glue)))
+		return res
+	}
+	exists := false
+	for _, rr := range zone.records {
+		exists = exists || under(t, rr.name, qname)
+		if strings.EqualFold(rr.name, qname) && rr.typ == qtype {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) > 0 {
+		return testResponse(t, q, 0, answer, nil)
+	}
+	soa := []testRR{{zone.origin, RR_SOA, 300, ""}}
+	if !exists {
+		return testResponse(t, q, 3, nil, soa)
+	}
+	return testResponse(t, q, 0, nil, soa)
+}
+
+// authServers запускает по авторитетной заглушке на каждый адрес 127.0.0.x с общим портом.
+// queries возвращает запросы в виде "адрес имя тип"
+func authServers(t *testing.T, servers map[string][]testZone) (string, func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+	var mu sync.Mutex
+	var queries []string
+	for ip, zones := range servers {
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			// 127.0.0.2 и выше есть не везде, например на macOS без алиасов lo0
+			t.Skipf("listen on %v: %v", ip, err)
+		}
+		serveUDP(t, pc, func(q []byte) []byte {
+			if msg, err := ParseMessage(q); err == nil && len(msg.Question) == 1 {
+				mu.Lock()
+				queries = append(queries, ip+" "+msg.Question[0].Name+" "+RRnames[msg.Question[0].Type])
+				mu.Unlock()
+			}
+			return authResponse(t, q, zones)
+		})
+	}
+	return port, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+// testIterator корень на 127.0.0.1, com и net на 127.0.0.2, example.com и other.net
+// на 127.0.0.3. у example.com только NS без glue из other.net
+func testIterator(t *testing.T) (*Iterator, func() []string) {
+	t.Helper()
+	port, queries := authServers(t, map[string][]testZone{
+		"127.0.0.1": {{".", []testRR{
+			{"com", RR_NS, 300, "a.gtld.net"},
+			{"net", RR_NS, 300, "a.gtld.net"},
+			{"a.gtld.net", RR_A, 300, "127.0.0.2"},
+		}}},
+		"127.0.0.2": {{"com", []testRR{
+			{"example.com", RR_NS, 300, "ns.other.net"},
+		}}, {"net", []testRR{
+			{"other.net", RR_NS, 300, "ns.other.net"},
+			{"ns.other.net", RR_A, 300, "127.0.0.3"},
+		}}},
+		"127.0.0.3": {{"example.com", []testRR{
+			{"www.example.com", RR_A, 300, "192.0.2.1"},
+			{"deep.sub.example.com", RR_A, 300, "192.0.2.2"},
+		}}, {"other.net", []testRR{
+			{"ns.other.net", RR_A, 300, "127.0.0.3"},
+			{"www.other.net", RR_A, 300, "192.0.2.3"},
+		}}},
+	})
+	it := NewIterator()
+	it.RootHints = []string{net.JoinHostPort("127.0.0.1", port)}
+	it.Port = port
+	return it, queries
+}
+
+func TestIterativeResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rrtype DnsType
+		qname  string
+		want   []interface{}
+		err    error
+	}{
+		{"glue", RR_A, "www.other.net", []interface{}{net.ParseIP("192.0.2.3").To4()}, nil},
+		{"NS without glue", RR_A, "www.example.com", []interface{}{net.ParseIP("192.0.2.1").To4()}, nil},
+		{"below empty non-terminal", RR_A, "deep.sub.example.com", []interface{}{net.ParseIP("192.0.2.2").To4()}, nil},
+		{"no data", RR_AAAA, "www.example.com", nil, nil},
+		{"NXDOMAIN", RR_A, "nx.example.com", nil, errNameError},
+	}
+	for _, minimise := range []bool{false, true} {
+		for _, tt := range tests {
+			it, _ := testIterator(t)
+			it.Minimise = minimise
+			res, _, err := Resolve(tt.rrtype, tt.qname, Config{Iterative: it})
+			if !errors.Is(err, tt.err) || !reflect.DeepEqual(res, tt.want) {
+				t.Errorf("%v, minimise %v: Resolve = %v, %v, want %v, %v", tt.name, minimise, res, err, tt.want, tt.err)
+			}
+		}
+	}
+}
+
+func TestIterativeDelegationCache(t *testing.T) {
+	it, queries := testIterator(t)
+	config := Config{Iterative: it}
+	if _, err := ResolveA("www.example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	n := len(queries())
+	if _, err := ResolveA("deep.sub.example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	// делегирование example.com уже известно, спрашивается сразу его сервер
+	if q := queries()[n:]; !reflect.DeepEqual(q, []string{"127.0.0.3 deep.sub.example.com A"}) {
+		t.Errorf("queries after cached delegation %v", q)
+	}
+}
+
+func TestIterativeMinimise(t *testing.T) {
+	it, queries := testIterator(t)
+	it.Minimise = true
+	if _, err := ResolveA("deep.sub.example.com", Config{Iterative: it}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries() {
+		// корень видит только имена зон первого уровня, com - не глубже example.com
+		if strings.HasPrefix(q, "127.0.0.1 ") && q != "127.0.0.1 com A" && q != "127.0.0.1 net A" {
+			t.Errorf("root got %q", q)
+		}
+		if strings.HasPrefix(q, "127.0.0.2 ") && strings.Contains(q, "sub.") {
+			t.Errorf("com got %q", q)
+		}
+	}
+}
+
+func TestMinimiseLabels(t *testing.T) {
+	tests := []struct {
+		known, total, step, want int
+	}{
+		{0, 3, 0, 1},
+		{2, 3, 1, 3},
+		{3, 3, 2, 3},
+		{2, 34, 0, 3},
+		{5, 34, 4, 9},
+		{5, 34, 9, 34},
+	}
+	for _, tt := range tests {
+		if got := minimiseLabels(tt.known, tt.total, tt.step); got != tt.want {
+			t.Errorf("minimiseLabels(%v, %v, %v) = %v, want %v", tt.known, tt.total, tt.step, got, tt.want)
+		}
+	}
+}
+
+// авторитетные серверы спрашиваются по обычному dns, даже если в конфиге задан другой транспорт
+func TestIterativeIgnoresTransport(t *testing.T) {
+	dot, err := NewDoT(DoTConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	doh, err := NewDoH(DoHConfig{URL: "https://127.0.0.1:1/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		return nil, errors.New("transport must not be used")
+	})
+	for _, config := range []Config{{TLS: dot}, {HTTPS: doh}, {Transport: failing}} {
+		it, _ := testIterator(t)
+		config.Iterative = it
+		ips, err := ResolveA("www.example.com", config)
+		if err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+			t.Errorf("ResolveA = %v, %v", ips, err)
+		}
+	}
+}
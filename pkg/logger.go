@@ -0,0 +1,16 @@
+package awesomedns
+
+// журнал через Config.Logger. без него библиотека ничего не пишет
+import (
+	"log/slog"
+)
+
+// логгер, который все отбрасывает
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (config Config) logger() *slog.Logger {
+	if config.Logger == nil {
+		return discardLogger
+	}
+	return config.Logger
+}
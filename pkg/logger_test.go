@@ -0,0 +1,115 @@
+package awesomedns
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// recordHandler запоминает все записи журнала
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+// messages qname записей с сообщением msg и уровнем level
+func (h *recordHandler) messages(msg string, level slog.Level) map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := map[string]int{}
+	for _, r := range h.records {
+		if r.Message != msg || r.Level != level {
+			continue
+		}
+		qname := ""
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "qname" {
+				qname = a.Value.String()
+			}
+			return true
+		})
+		res[qname]++
+	}
+	return res
+}
+
+func TestLoggerDefault(t *testing.T) {
+	if (Config{}).logger().Handler() != slog.DiscardHandler {
+		t.Fatalf("default handler %T", (Config{}).logger().Handler())
+	}
+	h := &recordHandler{}
+	if (Config{Logger: slog.New(h)}).logger().Handler() != h {
+		t.Fatal("Config.Logger not used")
+	}
+}
+
+// без Config.Logger ничего не попадает ни в slog.Default, ни в log
+func TestLoggerSilent(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger, output, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+	server := udpServer(t, answerByName(t))
+	names := []string{"a.example", "b.example"}
+	if _, err := BulkResolveA(names, Config{Server: server}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MegaBulkResolveA(names, Config{Server: server}); err != nil {
+		t.Fatal(err)
+	}
+	// ошибки тоже не пишутся
+	servfail, _ := countingServer(t, 2)
+	if _, err := ResolveA("a.example", Config{Server: servfail}); err == nil {
+		t.Fatal("SERVFAIL accepted")
+	}
+	if buf.Len() > 0 {
+		t.Errorf("default logger output:\n%s", buf.String())
+	}
+}
+
+func TestLoggerBulk(t *testing.T) {
+	tests := []struct {
+		name    string
+		resolve func([]string, Config) (map[string]Answer, error)
+	}{
+		{"BulkResolveA", BulkResolveA},
+		{"MegaBulkResolveA", MegaBulkResolveA},
+	}
+	names := []string{"a.example", "b.example", "c.example"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &recordHandler{}
+			config := Config{Server: udpServer(t, answerByName(t)), Logger: slog.New(h)}
+			res, err := tt.resolve(names, config)
+			if err != nil || len(res) != len(names) {
+				t.Fatalf("%v = %v, %v", tt.name, res, err)
+			}
+			recv := h.messages("recv", slog.LevelDebug)
+			for _, name := range names {
+				if recv[name] != 1 {
+					t.Errorf("recv records for %v: %v", name, recv[name])
+				}
+			}
+		})
+	}
+}
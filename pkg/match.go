@@ -0,0 +1,125 @@
+package awesomedns
+
+// защита от подмены ответов: случайный id, случайный регистр имени (draft-vixie-dnsext-dns0x20)
+// и проверка, что ответ пришел от сервера и относится к отправленному запросу
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errResponseMismatch = errors.New("response does not match query")
+
+func randomId() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// randomizeCase меняет регистр букв в имени случайным образом
+func randomizeCase(name string) (string, error) {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return "", err
+	}
+	res := []byte(name)
+	for i, c := range res {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case c >= 'a' && c <= 'z':
+			res[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			res[i] = c - 'A' + 'a'
+		}
+	}
+	return string(res), nil
+}
+
+// newQuery собирает запрос со случайным id и, если нужно, случайным регистром имени и OPT
+func newQuery(rrtype DnsType, qname string, config Config) ([]byte, error) {
+	qname, err := ToASCII(qname)
+	if err != nil {
+		return nil, err
+	}
+	if config.Randomize0x20 {
+		if qname, err = randomizeCase(qname); err != nil {
+			return nil, err
+		}
+	}
+	id, err := randomId()
+	if err != nil {
+		return nil, err
+	}
+	q, err := makeQuery(rrtype, qname, int(id))
+	if err != nil {
+		return nil, err
+	}
+	if config.Edns0 {
+		q = appendOpt(q, defaultEdnsUDPSize)
+	}
+	return q, nil
+}
+
+// verifyResponse проверяет id, флаг ответа и секцию запроса.
+// с exactCase имя должно совпасть побайтно, иначе без учета регистра
+func verifyResponse(query, response []byte, exactCase bool) error {
+	q, err := parseDnsHeader(query)
+	if err != nil {
+		return err
+	}
+	r, err := parseDnsHeader(response)
+	if err != nil {
+		return err
+	}
+	if r.Query {
+		return fmt.Errorf("%w: not a response", errResponseMismatch)
+	}
+	if r.ID != q.ID {
+		return fmt.Errorf("%w: id %v != %v", errResponseMismatch, r.ID, q.ID)
+	}
+	if r.QDCount != 1 {
+		return fmt.Errorf("%w: question number %v", errResponseMismatch, r.QDCount)
+	}
+	position := headerLen
+	sent, err := parseDnsQuestionSection(query, &position, map[int]string{})
+	if err != nil {
+		return err
+	}
+	position = headerLen
+	received, err := parseDnsQuestionSection(response, &position, map[int]string{})
+	if err != nil {
+		return err
+	}
+	if received.Type != sent.Type || received.Class != sent.Class {
+		return fmt.Errorf("%w: question %v != %v", errResponseMismatch, received, sent)
+	}
+	if exactCase && received.Name != sent.Name || !equalFoldASCII(received.Name, sent.Name) {
+		return fmt.Errorf("%w: question %v != %v", errResponseMismatch, received, sent)
+	}
+	return nil
+}
+
+// readFromServer читает датаграмму, отбрасывая пришедшие не от адреса, с которым соединен conn.
+// для tcp просто Read
+func readFromServer(conn net.Conn, buffer []byte) (int, error) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return conn.Read(buffer)
+	}
+	server, _ := conn.RemoteAddr().(*net.UDPAddr)
+	for {
+		read, from, err := udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			return read, err
+		}
+		if server == nil || from.IP.Equal(server.IP) && from.Port == server.Port {
+			return read, nil
+		}
+	}
+}
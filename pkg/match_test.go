@@ -0,0 +1,129 @@
+package awesomedns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestVerifyResponse(t *testing.T) {
+	query, err := makeQuery(RR_A, "ExAmple.com", 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}
+	reply := func(change func(r []byte) []byte) []byte {
+		r := testResponse(t, query, 0, answer, nil)
+		if change != nil {
+			r = change(r)
+		}
+		return r
+	}
+	other := func(typ DnsType, name string) func([]byte) []byte {
+		return func(r []byte) []byte {
+			q, err := makeQuery(typ, name, 0x1234)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return testResponse(t, q, 0, answer, nil)
+		}
+	}
+	tests := []struct {
+		name      string
+		response  []byte
+		exactCase bool
+		mismatch  bool
+	}{
+		{"match", reply(nil), true, false},
+		{"wrong id", reply(func(r []byte) []byte {
+			binary.BigEndian.PutUint16(r, 0x4321)
+			return r
+		}), false, true},
+		{"qr unset", reply(func(r []byte) []byte {
+			r[2] &^= 0b1000_0000
+			return r
+		}), false, true},
+		{"no question", reply(func(r []byte) []byte {
+			binary.BigEndian.PutUint16(r[4:], 0)
+			return r
+		}), false, true},
+		{"wrong type", reply(other(RR_AAAA, "ExAmple.com")), false, true},
+		{"wrong name", reply(other(RR_A, "example.net")), false, true},
+		{"case differs without 0x20", reply(other(RR_A, "example.com")), false, false},
+		{"case differs with 0x20", reply(other(RR_A, "example.com")), true, true},
+	}
+	for _, tt := range tests {
+		err := verifyResponse(query, tt.response, tt.exactCase)
+		if tt.mismatch != errors.Is(err, errResponseMismatch) || !tt.mismatch && err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example-1.com"
+	for i := 0; i < 10; i++ {
+		got, err := randomizeCase(name)
+		if err != nil || !equalFoldASCII(got, name) {
+			t.Fatalf("randomizeCase(%q) = %q, %v", name, got, err)
+		}
+	}
+}
+
+// поддельные ответы не обрывают ожидание настоящего
+func TestExchangeDropsSpoofedReplies(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spoofer.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := append([]byte(nil), buf[:n]...)
+		fake := func(rr testRR) []byte {
+			return testResponse(t, q, 0, []testRR{rr}, nil)
+		}
+		// с чужого порта
+		spoofer.WriteTo(fake(testRR{"example.com", RR_A, 60, "203.0.113.1"}), addr)
+		// с неверным id
+		wrongId := fake(testRR{"example.com", RR_A, 60, "203.0.113.2"})
+		wrongId[0]++
+		pc.WriteTo(wrongId, addr)
+		// не ответ
+		notResponse := fake(testRR{"example.com", RR_A, 60, "203.0.113.3"})
+		notResponse[2] &^= 0b1000_0000
+		pc.WriteTo(notResponse, addr)
+		pc.WriteTo(fake(testRR{"example.com", RR_A, 60, "192.0.2.1"}), addr)
+	}()
+	res, err := ResolveA("example.com", Config{Server: pc.LocalAddr().String(), Randomize0x20: true})
+	if err != nil || len(res) != 1 || !res[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("ResolveA = %v, %v", res, err)
+	}
+}
+
+func TestNewQueryEdns0(t *testing.T) {
+	for _, edns0 := range []bool{false, true} {
+		q, err := newQuery(RR_A, "example.com", Config{Edns0: edns0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ParseMessage(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasOpt := len(msg.Additional) == 1 && msg.Additional[0].Type == RR_OPT && uint16(msg.Additional[0].Class) == defaultEdnsUDPSize
+		if hasOpt != edns0 || !edns0 && len(msg.Additional) != 0 {
+			t.Errorf("Edns0 %v: additional %+v", edns0, msg.Additional)
+		}
+	}
+}
@@ -2,15 +2,18 @@ package awesomedns
 
 import (
 	"context"
-	"log"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
 	"net"
 	"time"
 )
 
 type waitStatus struct {
-	fqdn string
-	sent time.Time
-	ok   bool
+	fqdn  string
+	sent  time.Time
+	ok    bool
+	query []byte // запрос сохраняется для перепосылки и сверки с ответом
 }
 
 func extractIp(items []interface{}) []net.IP {
@@ -24,7 +27,7 @@ func extractIp(items []interface{}) []net.IP {
 	return res
 }
 
-func connWriter(req chan []byte, conn net.Conn, rate int, ctx context.Context) {
+func connWriter(req chan []byte, conn net.Conn, rate int, config Config, ctx context.Context) {
 	if rate > 1_000_000 {
 		rate = 1_000_000
 	}
@@ -43,14 +46,17 @@ func connWriter(req chan []byte, conn net.Conn, rate int, ctx context.Context) {
 		}
 		written, err := conn.Write(msg)
 		if written != len(msg) || err != nil {
-			log.Printf("unable to send %v err=%v", msg, err)
+			config.logger().Warn("unable to send", "msg", msg, "err", err)
+		} else {
+			config.Pcap.record(config.logger(), conn.LocalAddr(), conn.RemoteAddr(), msg)
+			config.Dnstap.recordQuery(config.logger(), dnstapProtocolUDP, conn.LocalAddr(), conn.RemoteAddr(), msg)
 		}
 		// простая реализация выдерживание периода
 		time.Sleep(period)
 	}
 }
 
-func connReader(answers chan []byte, conn net.Conn, ctx context.Context) {
+func connReader(answers chan []byte, conn net.Conn, config Config, ctx context.Context) {
 	buffer := make([]byte, 1024)
 	for {
 		select {
@@ -58,78 +64,178 @@ func connReader(answers chan []byte, conn net.Conn, ctx context.Context) {
 			return
 		default:
 		}
-		read, err := conn.Read(buffer)
+		read, err := readFromServer(conn, buffer)
 		if err != nil {
-			log.Printf("unable to read %v", err)
+			config.logger().Warn("unable to read", "err", err)
 		} else {
 			tmp := make([]byte, read)
 			copy(tmp, buffer)
+			config.Pcap.record(config.logger(), conn.RemoteAddr(), conn.LocalAddr(), tmp)
 			answers <- tmp
 		}
 	}
 }
 
+// transportWriter отправляет запросы через Transport, каждый в своей горутине, ответы пишет в answers
+func transportWriter(req chan []byte, answers chan []byte, transport Transport, rate int, timeout time.Duration, dnstap *DnstapWriter, logger *slog.Logger, ctx context.Context) {
+	if rate > 1_000_000 {
+		rate = 1_000_000
+	}
+
+	period := time.Duration(1_000_000_000 / rate) // nano
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		msg, ok := <-req
+		if !ok {
+			return
+		}
+		dnstap.recordQuery(logger, dnstapProtocolUDP, nil, nil, msg)
+		go func(msg []byte) {
+			exchangeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			answer, err := transport.Exchange(exchangeCtx, msg)
+			if err != nil {
+				logger.Warn("unable to exchange", "msg", msg, "err", err)
+				return
+			}
+			select {
+			case answers <- answer:
+			case <-ctx.Done():
+			}
+		}(msg)
+		time.Sleep(period)
+	}
+}
+
 func MegaBulkResolveA(req []string, config Config) (map[string]Answer, error) {
 	rate := 1    // pps
 	timeout := 10 // s
 	var res = map[string]Answer{}
-	var inwait = map[int]*waitStatus{} // отслеживание статуса запроса. нужно для перепосылки
-	ctx, cancel := context.WithCancel(context.Background())
-
-	conn, err := net.Dial("udp", config.Server)
-	if err != nil {
-		return res, err
+	var inwait = map[uint16]*waitStatus{} // отслеживание статуса запроса по id. нужно для перепосылки
+	if len(req) > 1<<16 {
+		return res, fmt.Errorf("too many queries %v > %v", len(req), 1<<16)
+	}
+	servers := config.servers()
+	if len(servers) == 0 && config.Transport == nil {
+		return res, errNoServers
 	}
-	//conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-
 	writerCh := make(chan []byte, 10)
 	defer close(writerCh)
+	// не закрывается: в него пишут несколько горутин, которые завершаются по ctx
 	readerCh := make(chan []byte, 1000)
-	defer close(readerCh)
 
-	go connWriter(writerCh, conn, rate, ctx)
-	go connReader(readerCh, conn, ctx)
+	var localAddr, remoteAddr net.Addr
+	dnstap := config.Dnstap
+	// через транспорт метрики считает он сам
+	var metrics *Metrics
+	var server string
+	if config.Transport != nil || config.isTCP() || len(config.Middleware) > 0 {
+		if config.Transport == nil {
+			// встроенный транспорт сам пишет dnstap
+			dnstap = nil
+		}
+		// общий сокет есть только у udp, tcp, DoT и DoH идут через транспорт первого сервера.
+		// middleware работают только с обменом запрос-ответ, поэтому и с ними тоже
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go transportWriter(writerCh, readerCh, config.upstreams()[0].transport, rate, time.Duration(timeout)*time.Second, dnstap, config.logger(), ctx)
+	} else {
+		dialer, err := config.dialer("udp")
+		if err != nil {
+			return res, err
+		}
+		conn, err := dialer.Dial("udp", servers[0])
+		if err != nil {
+			return res, err
+		}
+		//conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		localAddr, remoteAddr = conn.LocalAddr(), conn.RemoteAddr()
+		metrics, server = config.Metrics, servers[0]
+		go connWriter(writerCh, conn, rate, config, ctx)
+		go connReader(readerCh, conn, config, ctx)
+	}
 
-	for i, fqdn := range req {
-		inwait[i] = &waitStatus{fqdn, time.Time{}, false}
+	for _, fqdn := range req {
+		if records, ok, err := config.Cache.get(fqdn, RR_A, nil); ok {
+			res[fqdn] = Answer{extractIp(recordsData(records)), err}
+			continue
+		}
+		qmsg, err := newQuery(RR_A, fqdn, config)
+		if err != nil {
+			// имя не закодировать, перепосылка не поможет
+			config.logger().Warn("newQuery error", "qname", fqdn, "err", err)
+			res[fqdn] = Answer{nil, err}
+			continue
+		}
+		// id уникальны в пределах пачки, иначе ответы не сопоставить
+		for err == nil && inwait[binary.BigEndian.Uint16(qmsg)] != nil {
+			var id uint16
+			if id, err = randomId(); err == nil {
+				binary.BigEndian.PutUint16(qmsg, id)
+			}
+		}
+		if err != nil {
+			res[fqdn] = Answer{nil, err}
+			continue
+		}
+		inwait[binary.BigEndian.Uint16(qmsg)] = &waitStatus{fqdn, time.Time{}, false, qmsg}
 	}
 	for {
 		if len(inwait) == 0 {
 			break
 		}
-		for k, v := range inwait {
+		for _, v := range inwait {
 			if time.Now().Sub(v.sent) > time.Duration(timeout)*time.Second {
-				qmsg, err := makeQuery(RR_A, v.fqdn, k)
-				if err != nil {
-					log.Printf("makeQuery error %v for %v", err, v)
-					continue
+				if !v.sent.IsZero() {
+					metrics.timeout(server)
+					metrics.retry(server)
 				}
-				writerCh <- qmsg
+				writerCh <- v.query
+				metrics.query(server)
 				v.sent = time.Now()
 			}
 		}
 		select {
 		case msg := <-readerCh:
-			ret, transactionId, err := parseDnsAnswer(msg)
-			if err != nil {
-				if err == errNameError {
-				} else {
-					log.Printf("unable to parse %v %v", msg, err)
-				}
-			} else {
-				log.Printf("recv %v %v %v", ret, transactionId, err)
+			var q *waitStatus
+			if len(msg) >= 2 {
+				q = inwait[binary.BigEndian.Uint16(msg)]
 			}
-			q, ok := inwait[transactionId]
-			if !ok {
-				log.Printf("received unknown msg with transactionId=%v", transactionId)
+			if q == nil {
+				dnstap.recordResponse(config.logger(), dnstapProtocolUDP, time.Time{}, localAddr, remoteAddr, msg)
+				config.logger().Debug("received unknown msg", "msg", msg)
+			} else if err := verifyResponse(q.query, msg, config.Randomize0x20); err != nil {
+				dnstap.recordResponse(config.logger(), dnstapProtocolUDP, q.sent, localAddr, remoteAddr, msg)
+				config.logger().Warn("drop response", "qname", q.fqdn, "err", err)
 			} else {
-				delete(inwait, transactionId)
+				dnstap.recordResponse(config.logger(), dnstapProtocolUDP, q.sent, localAddr, remoteAddr, msg)
+				metrics.response(server, msg, time.Since(q.sent))
+				if isTruncated(msg) {
+					metrics.truncated(server)
+				}
+				config.Cache.storeResponse(q.fqdn, RR_A, msg)
+				ret, transactionId, err := parseDnsAnswer(msg, config.UnicodeNames)
+				if err != nil {
+					if err == errNameError {
+					} else {
+						config.logger().Warn("unable to parse", "msg", msg, "err", err)
+					}
+				} else {
+					config.logger().Debug("recv", "qname", q.fqdn, "records", ret, "id", transactionId)
+				}
+				delete(inwait, uint16(transactionId))
 				res[q.fqdn] = Answer{extractIp(ret), err}
 			}
 		case <-time.After(1 * time.Second):
 		}
 
 	}
-	cancel()
 	return res, nil
 }
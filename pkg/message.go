@@ -7,9 +7,9 @@
 // +---------------------+
 // |        Answer       | ответ. может быть несколько в том числе разного типа
 // +---------------------+
-// |      Authority      | RRs pointing toward an authority - не реализовано
+// |      Authority      | RRs pointing toward an authority - разбирается только в ParseMessage
 // +---------------------+
-// |      Additional     | RRs holding additional information - не реализовано
+// |      Additional     | RRs holding additional information - разбирается только в ParseMessage
 // +---------------------+
 
 package awesomedns
@@ -18,14 +18,69 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Config struct {
-	Server string
+	// если задан, все запросы идут через него, серверы и встроенные транспорты не используются
+	Transport Transport
+	// обертки вокруг каждого обмена с сервером, включая итеративный и массовые режимы
+	Middleware []Middleware
+	// если задан, имена разрешаются итеративно от корневых серверов. Transport,
+	// серверы, TLS и HTTPS тогда не используются
+	Iterative *Iterator
+	Server    string
+	// дополнительные серверы, опрашиваются после Server при SERVFAIL, REFUSED и таймаутах
+	Servers []string
+	// число проходов по списку серверов, как attempts в resolv.conf. по умолчанию 1
+	Attempts int
+	// начинать каждый запрос со следующего сервера, как rotate в resolv.conf.
+	// очередь общая для вызовов одного Resolver
+	Rotate bool
 	IsTCP  bool
+	// адрес для отправки запросов, "192.0.2.1" или "192.0.2.1:5353". с фиксированным портом
+	// параллельные запросы по udp не получатся
+	LocalAddr string
+	// интерфейс для SO_BINDTODEVICE, только linux. TCPPool.Dial и DoH используют свои Dial
+	BindDevice string
+	// если задан, tcp запросы идут через постоянные соединения пула
+	TCPPool *TCPPool
+	// если задан, запросы идут по DNS-over-TLS, IsTCP и TCPPool не используются
+	TLS *DoT
+	// если задан, запросы идут по DNS-over-HTTPS. серверы - шаблоны адресов,
+	// по умолчанию адрес из DoHConfig
+	HTTPS *DoH
+	// если задан, сюда считаются запросы, ответы и время ответа по серверам
+	Metrics *Metrics
+	Pcap    *PcapWriter   // если задан, все запросы и ответы записываются в захват
+	Dnstap  *DnstapWriter // если задан, все запросы и ответы пишутся в dnstap
+	// журнал: отказы серверов на Warn, каждый запрос и ответ на Debug. по умолчанию молчит
+	Logger *slog.Logger
+	// переводить punycode имена в ответах в unicode
+	UnicodeNames bool
+	// случайный регистр букв в запросе (dns 0x20), ответ должен повторить его точно
+	Randomize0x20 bool
+	// домены для дополнения коротких имен и порог точек, как search и ndots в resolv.conf
+	Search []string
+	Ndots  int
+	// если задан, ответы берутся из него и сохраняются в него. общий для Resolver,
+	// BulkResolveA и MegaBulkResolveA с тем же Config
+	Cache *Cache
+	// статические записи для ResolveA, ResolveAaaa и ResolvePtr, nil - только dns
+	Hosts      *Hosts
+	HostsOrder HostsOrder
+	// отправлять OPT запись с размером udp буфера (rfc6891)
+	Edns0 bool
+	// таймауты на обмен с одним сервером. без них действует дедлайн контекста, а если нет и его, 15 секунд
+	UDPTimeout time.Duration
+	TCPTimeout time.Duration
+
+	// счетчик для Rotate, его заводит NewResolver
+	rotation *atomic.Uint32
 }
 
 type DnsSoa struct {
@@ -119,6 +174,8 @@ const (
 	RR_LOC   DnsType = 29 // rfc1876
 	RR_SRV   DnsType = 33
 	RR_NAPTR DnsType = 35 // rfc2915
+	RR_DNAME DnsType = 39 // rfc6672
+	RR_OPT   DnsType = 41 // rfc6891
 	RR_AXFR  DnsType = 252
 	RR_ANY   DnsType = 255
 )
@@ -138,6 +195,8 @@ var RRnames = map[DnsType]string{
 	RR_LOC:   "LOC",
 	RR_SRV:   "SRV",
 	RR_NAPTR: "NAPTR",
+	RR_DNAME: "DNAME",
+	RR_OPT:   "OPT",
 	RR_AXFR:  "RR_AXFR",
 	RR_ANY:   "ANY",
 }
@@ -152,7 +211,7 @@ var ClassNames = map[DnsType]string{
 	ClassIN: "IN",
 }
 
-const MaxLabelLen = 163
+const MaxLabelLen = 63
 const MaxNameLen = 255
 
 var (
@@ -165,56 +224,123 @@ var (
 	errCompressionMask = errors.New("wrong compression mask")
 )
 
-func parseDnsAnswer(data []byte) ([]interface{}, int, error) {
+// DnsRecord запись ресурса из любой секции ответа
+type DnsRecord struct {
+	DnsAnswerHeader
+	Data interface{}
+}
+
+// DnsUnknown данные записи неподдерживаемого типа как есть
+type DnsUnknown struct {
+	Type DnsType
+	Data []byte
+}
+
+// DnsMessage полностью разобранное сообщение, запрос или ответ
+type DnsMessage struct {
+	Header     DnsMessageHeader
+	Question   []DnsRequestedInAnswer
+	Answer     []DnsRecord
+	Authority  []DnsRecord
+	Additional []DnsRecord
+}
+
+func rcodeError(rcode uint8) error {
+	switch rcode {
+	case 0:
+		return nil
+	case 1:
+		return errFormat
+	case 2:
+		return errServFail
+	case 3:
+		return errNameError
+	case 4:
+		return errNotImplemented
+	case 5:
+		return errRefused
+	default:
+		return fmt.Errorf("unknown answer error %v", rcode)
+	}
+}
+
+// ParseMessage разбирает сообщение целиком, включая секции authority и additional.
+// код ошибки в заголовке не проверяется
+func ParseMessage(data []byte) (DnsMessage, error) {
+	var msg DnsMessage
+	header, err := parseDnsHeader(data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Header = header
+	var namesCache = map[int]string{}
+	var position = headerLen
+	for i := 0; i < int(header.QDCount); i++ {
+		question, err := parseDnsQuestionSection(data, &position, namesCache)
+		if err != nil {
+			return msg, err
+		}
+		msg.Question = append(msg.Question, question)
+	}
+	sections := []*[]DnsRecord{&msg.Answer, &msg.Authority, &msg.Additional}
+	counts := []uint16{header.ANCount, header.NSCount, header.ARCount}
+	for i, section := range sections {
+		for j := 0; j < int(counts[i]); j++ {
+			rr, rrHeader, err := parseDnsAnswerSection(data, &position, namesCache)
+			if err != nil {
+				return msg, err
+			}
+			*section = append(*section, DnsRecord{rrHeader, rr})
+		}
+	}
+	return msg, nil
+}
+
+func parseDnsAnswer(data []byte, unicodeNames bool) ([]interface{}, int, error) {
+	records, transactionId, err := parseDnsRecords(data, unicodeNames)
+	if err != nil {
+		return nil, transactionId, err
+	}
+	return recordsData(records), transactionId, nil
+}
+
+// parseDnsRecords секция answer вместе с заголовками записей
+func parseDnsRecords(data []byte, unicodeNames bool) ([]DnsRecord, int, error) {
 	var transactionId int
-	var ret []interface{}
+	var ret []DnsRecord
 	ans, err := parseDnsHeader(data)
 	if err != nil {
 		return nil, transactionId, err
 	}
 	transactionId = int(ans.ID)
-	if ans.RCode > 0 {
-		switch ans.RCode {
-		case 1:
-			err = errFormat
-		case 2:
-			err = errServFail
-		case 3:
-			err = errNameError
-		case 4:
-			err = errNotImplemented
-		case 5:
-			err = errRefused
-		default:
-			err = fmt.Errorf("unknown answer error %v", ans.RCode)
-		}
+	if err = rcodeError(ans.RCode); err != nil {
 		return nil, transactionId, err
 	}
-	var namesCache = map[int]string{}
-	var position int = 12 // длина заголовка
 	if ans.QDCount != 1 {
 		// кажется нигде не описано и никто не поддерживает больше одного запроса
 		return nil, transactionId, fmt.Errorf("unsupported question number %v", ans.QDCount)
 	}
-	for i := 0; i < int(ans.QDCount); i++ {
-		// парсим запрос так как на него могут ссылаться в ответе
-		answerQuestion, err := parseDnsQuestionSection(data, &position, namesCache)
-		log.Println("answer question:", answerQuestion)
-		if err != nil {
-			return nil, transactionId, err
-		}
+	msg, err := ParseMessage(data)
+	if err != nil {
+		return nil, transactionId, err
 	}
-	for i := 0; i < int(ans.ANCount); i++ {
-		answer, header, err := parseDnsAnswerSection(data, &position, namesCache)
-		if err != nil {
-			return nil, transactionId, err
+	for _, rr := range msg.Answer {
+		if unicodeNames {
+			rr = rr.unicodeNames()
 		}
-		ret = append(ret, answer)
-		log.Println("answer section:", header, answer)
+		ret = append(ret, rr)
 	}
 	return ret, transactionId, nil
 }
 
+func recordsData(records []DnsRecord) []interface{} {
+	var ret []interface{}
+	for _, rr := range records {
+		ret = append(ret, rr.Data)
+	}
+	return ret
+}
+
 func makeQuery(rrtype DnsType, qname string, requestId int) ([]byte, error) {
 	res := make([]byte, 400)
 	var header = DnsMessageHeader{}
@@ -278,10 +404,13 @@ func readName(data []byte, nameCache map[int]string, packetPos int) (string, int
 	// декодирование строки
 	// кодируется как байт с длинной n и последующие n байт имени
 	var labels []string
-	var label string
+	var labelLens []int // длины меток в пакете, экранированные могут быть длиннее
 	var name string
 	currentOffset := 0
 	for {
+		if currentOffset >= len(data) {
+			return name, currentOffset, errFormat
+		}
 		namePartLen := int(data[currentOffset])
 		if namePartLen > MaxLabelLen {
 			// rfc1035 4.1.4 компрессия
@@ -289,6 +418,9 @@ func readName(data []byte, nameCache map[int]string, packetPos int) (string, int
 				return name, currentOffset, errCompressionMask
 			}
 			// cтаршие 2 бита это флаг компрессии, а оставшиеся - смещение от начала пакета
+			if currentOffset+2 > len(data) {
+				return name, currentOffset, errFormat
+			}
 			offset := binary.BigEndian.Uint16(data[currentOffset:currentOffset+2]) << 2 >> 2
 			if offset < headerLen {
 				return name, currentOffset, fmt.Errorf("offset is too small %v", offset)
@@ -305,45 +437,45 @@ func readName(data []byte, nameCache map[int]string, packetPos int) (string, int
 			if namePartLen == 0 {
 				break
 			}
-			label = string(data[currentOffset : namePartLen+currentOffset])
-			labels = append(labels, label)
+			if currentOffset+namePartLen > len(data) {
+				return name, currentOffset, errFormat
+			}
+			labels = append(labels, escapeLabel(string(data[currentOffset:namePartLen+currentOffset])))
+			labelLens = append(labelLens, namePartLen)
 			currentOffset += namePartLen
 		}
 	}
 	labelIndex := 0
-	for i, label := range labels {
+	for i := range labelLens {
 		nameCache[labelIndex+packetPos] = strings.Join(labels[i:], ".")
-		labelIndex += len(label)
+		labelIndex += labelLens[i]
 		labelIndex++
 	}
 	return strings.Join(labels, "."), currentOffset, nil
 }
 
 func encodeName(s string) ([]byte, error) {
-	res := make([]byte, MaxNameLen)
-	var pos int = 0
-	for _, element := range strings.Split(s, ".") {
-		if len(element) > MaxLabelLen {
-			return nil, fmt.Errorf("name %v is too long %v > %v", element, len(element), MaxLabelLen)
-		}
-		res[pos] = byte(len(element))
-		pos++
-		copy(res[pos:], element)
-		pos += len(element)
-		if pos+1 > MaxNameLen {
-			return nil, errors.New("too long name to encode")
-		}
+	name, err := ParseName(s)
+	if err != nil {
+		return nil, err
 	}
-	res[pos] = 0
-	pos++
-	return res[0:pos], nil
+	return name.appendWire(make([]byte, 0, name.WireLen())), nil
 }
 
 func parseDnsQuestionSection(data []byte, position *int, nameCache map[int]string) (DnsRequestedInAnswer, error) {
 	var pos = *position
 	var res DnsRequestedInAnswer
-	name, read, _ := readName(data[pos:], nameCache, pos)
+	if pos >= len(data) {
+		return res, errFormat
+	}
+	name, read, err := readName(data[pos:], nameCache, pos)
+	if err != nil {
+		return res, err
+	}
 	pos += read
+	if pos+4 > len(data) {
+		return res, errFormat
+	}
 
 	typ := binary.BigEndian.Uint16(data[pos : pos+2])
 	pos += 2
@@ -379,11 +511,17 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 	var pos = *position
 	var ret interface{}
 	var header DnsAnswerHeader
+	if pos >= len(data) {
+		return nil, header, errFormat
+	}
 	name, read, err := readName(data[pos:], nameCache, pos)
 	if err != nil {
 		return nil, header, err
 	}
 	pos += read
+	if pos+10 > len(data) {
+		return nil, header, errFormat
+	}
 
 	typ := binary.BigEndian.Uint16(data[pos : pos+2])
 	pos += 2
@@ -396,6 +534,9 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 
 	rdlength := binary.BigEndian.Uint16(data[pos : pos+2])
 	pos += 2
+	if pos+int(rdlength) > len(data) {
+		return nil, header, errFormat
+	}
 	rdata := make([]byte, rdlength)
 	copy(rdata, data[pos:pos+int(rdlength)])
 	switch DnsType(typ) {
@@ -409,7 +550,7 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 			return nil, header, fmt.Errorf("wrong data size for AAAA type - %v", rdlength)
 		}
 		ret = net.IP(rdata)
-	case RR_CNAME, RR_NS, RR_PTR:
+	case RR_CNAME, RR_NS, RR_PTR, RR_DNAME:
 		ret, _, err = readName(rdata, nameCache, pos)
 		if err != nil {
 			return nil, header, err
@@ -419,17 +560,25 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 		if err != nil {
 			return nil, header, err
 		}
-		soa_rname, _, err := readName(rdata[read:], nameCache, pos+read)
+		soa_rname, read2, err := readName(rdata[read:], nameCache, pos+read)
 		if err != nil {
 			return nil, header, err
 		}
-		serial := binary.BigEndian.Uint32(rdata)
-		refresh := binary.BigEndian.Uint32(rdata[4:])
-		retry := binary.BigEndian.Uint32(rdata[8:])
-		expire := binary.BigEndian.Uint32(rdata[12:])
-		minimum := binary.BigEndian.Uint32(rdata[16:])
+		// числа идут после обоих имен
+		numbers := rdata[read+read2:]
+		if len(numbers) < 20 {
+			return nil, header, errFormat
+		}
+		serial := binary.BigEndian.Uint32(numbers)
+		refresh := binary.BigEndian.Uint32(numbers[4:])
+		retry := binary.BigEndian.Uint32(numbers[8:])
+		expire := binary.BigEndian.Uint32(numbers[12:])
+		minimum := binary.BigEndian.Uint32(numbers[16:])
 		ret = DnsSoa{soa_name, soa_rname, serial, refresh, retry, expire, minimum}
 	case RR_MX:
+		if len(rdata) < 2 {
+			return nil, header, errFormat
+		}
 		preference := binary.BigEndian.Uint16(rdata)
 		exchange, _, err := readName(rdata[2:], nameCache, pos+2)
 		if err != nil {
@@ -437,6 +586,9 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 		}
 		ret = DnsMx{preference, exchange}
 	case RR_SRV:
+		if len(rdata) < 6 {
+			return nil, header, errFormat
+		}
 		priority := binary.BigEndian.Uint16(rdata)
 		weight := binary.BigEndian.Uint16(rdata[2:])
 		port := binary.BigEndian.Uint16(rdata[4:])
@@ -446,14 +598,27 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 		}
 		ret = DnsSRV{priority, weight, port, target}
 	case RR_HINFO:
-		cpuLength := rdata[0]
-		cpu := string(rdata[1 : int(cpuLength)+1])
+		cpu, _, err := readCharString(rdata, 0)
+		if err != nil {
+			return nil, header, err
+		}
 		ret = cpu
 	case RR_TXT:
-		txtLength := rdata[0]
-		txt := string(rdata[1 : int(txtLength)+1])
+		// строки записи склеиваются, как в net.LookupTXT
+		txt, next, err := readCharString(rdata, 0)
+		for err == nil && next < len(rdata) {
+			var s string
+			s, next, err = readCharString(rdata, next)
+			txt += s
+		}
+		if err != nil {
+			return nil, header, err
+		}
 		ret = txt
 	case RR_AFSDB:
+		if len(rdata) < 2 {
+			return nil, header, errFormat
+		}
 		//subtype := binary.BigEndian.Uint16(rdata)
 		hostname, _, err := readName(rdata[2:], nameCache, pos+2)
 		if err != nil {
@@ -461,25 +626,32 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 		}
 		ret = hostname
 	case RR_LOC:
+		if len(rdata) < 2 {
+			return nil, header, errFormat
+		}
 		version := rdata[0]
 		size := rdata[1]
 		// TODO: декодировать остальные поля
 		ret = DnsLoc{version, size}
 	case RR_NAPTR:
+		if len(rdata) < 4 {
+			return nil, header, errFormat
+		}
 		order := binary.BigEndian.Uint16(rdata)
 		pref := binary.BigEndian.Uint16(rdata[2:])
-		flag_length := rdata[4]
-		rdataPos := 5
-		flag := string(rdata[rdataPos : rdataPos+int(flag_length)])
-		rdataPos += int(flag_length)
-		service_length := rdata[rdataPos]
-		rdataPos++
-		service := string(rdata[rdataPos : rdataPos+int(service_length)])
-		rdataPos += int(service_length)
-		regexLength := rdata[rdataPos]
-		rdataPos++
-		regex := string(rdata[rdataPos : rdataPos+int(regexLength)])
-		rdataPos += int(regexLength)
+		rdataPos := 4
+		flag, rdataPos, err := readCharString(rdata, rdataPos)
+		if err != nil {
+			return nil, header, err
+		}
+		service, rdataPos, err := readCharString(rdata, rdataPos)
+		if err != nil {
+			return nil, header, err
+		}
+		regex, rdataPos, err := readCharString(rdata, rdataPos)
+		if err != nil {
+			return nil, header, err
+		}
 		replacement, _, err := readName(rdata[rdataPos:], nameCache, pos+rdataPos)
 		if err != nil {
 			return nil, header, err
@@ -495,8 +667,13 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 			return nil, header, err
 		}
 		ret = DnsRp{mailbox, txtRR}
+	case RR_OPT:
+		ret, err = parseOpt(rdata)
+		if err != nil {
+			return nil, header, err
+		}
 	default:
-		return nil, header, fmt.Errorf("unsupported data type %v", typ)
+		ret = DnsUnknown{DnsType(typ), rdata}
 	}
 	header = DnsAnswerHeader{name, DnsType(typ), class(klass), ttl}
 	pos += int(rdlength)
@@ -504,6 +681,15 @@ func parseDnsAnswerSection(data []byte, position *int, nameCache map[int]string)
 	return ret, header, nil
 }
 
+// readCharString <character-string> (rfc1035 3.3): байт длины и строка. возвращает позицию после нее
+func readCharString(data []byte, pos int) (string, int, error) {
+	if pos >= len(data) || pos+1+int(data[pos]) > len(data) {
+		return "", pos, errFormat
+	}
+	end := pos + 1 + int(data[pos])
+	return string(data[pos+1 : end]), end, nil
+}
+
 func parseDnsHeader(data []byte) (DnsMessageHeader, error) {
 	var res DnsMessageHeader
 	if len(data) < 12 {
@@ -512,15 +698,15 @@ func parseDnsHeader(data []byte) (DnsMessageHeader, error) {
 	res.ID = binary.BigEndian.Uint16(data[0:2])
 	tmp := uint8(data[2])
 	res.Query = tmp&0b1000_0000 == 0
-	res.Opcode = tmp & 0b111_1000
-	res.AA = tmp&0b100 == 1
-	res.TC = tmp&0b10 == 1
-	res.RD = tmp&0b1 == 1
+	res.Opcode = (tmp & 0b111_1000) >> 3
+	res.AA = tmp&0b100 != 0
+	res.TC = tmp&0b10 != 0
+	res.RD = tmp&0b1 != 0
 	tmp = data[3]
-	res.RA = tmp&0b1000_0000 == 1
-	res.Z = tmp&0b100_0000 == 1
-	res.AC = tmp&0b10_0000 == 1
-	res.CD = tmp&0b1_0000 == 1
+	res.RA = tmp&0b1000_0000 != 0
+	res.Z = tmp&0b100_0000 != 0
+	res.AC = tmp&0b10_0000 != 0
+	res.CD = tmp&0b1_0000 != 0
 	res.RCode = tmp & 0b1111
 	res.QDCount = binary.BigEndian.Uint16(data[4:6])
 	res.ANCount = binary.BigEndian.Uint16(data[6:8])
@@ -0,0 +1,134 @@
+package awesomedns
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// responseWithRR ответ на запрос example.com с одной записью типа typ и данными rdata
+func responseWithRR(t *testing.T, typ DnsType, rdata []byte) []byte {
+	t.Helper()
+	q, err := makeQuery(RR_A, "example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := testResponse(t, q, 0, nil, nil)
+	binary.BigEndian.PutUint16(res[6:], 1)
+	owner, err := encodeName("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = append(res, owner...)
+	res = binary.BigEndian.AppendUint16(res, uint16(typ))
+	res = binary.BigEndian.AppendUint16(res, uint16(ClassIN))
+	res = binary.BigEndian.AppendUint32(res, 60)
+	res = binary.BigEndian.AppendUint16(res, uint16(len(rdata)))
+	return append(res, rdata...)
+}
+
+func TestParseHeaderFlags(t *testing.T) {
+	tests := []struct {
+		flags [2]byte
+		want  DnsMessageHeader
+	}{
+		{[2]byte{0, 0}, DnsMessageHeader{Query: true}},
+		{[2]byte{0b1000_0101, 0b1000_0011}, DnsMessageHeader{AA: true, RD: true, RA: true, RCode: 3}},
+		{[2]byte{0b1001_0010, 0b0111_0000}, DnsMessageHeader{Opcode: 2, TC: true, Z: true, AC: true, CD: true}},
+		{[2]byte{0b0010_1000, 0}, DnsMessageHeader{Query: true, Opcode: 5}},
+	}
+	for _, tt := range tests {
+		data := make([]byte, headerLen)
+		data[2], data[3] = tt.flags[0], tt.flags[1]
+		header, err := parseDnsHeader(data)
+		if err != nil || header != tt.want {
+			t.Errorf("flags %08b: %+v, %v, want %+v", tt.flags, header, err, tt.want)
+		}
+	}
+}
+
+func TestParseRdata(t *testing.T) {
+	name, _ := encodeName("mail.example.com")
+	soa, _ := encodeName("ns.example.com")
+	rname, _ := encodeName("hostmaster.example.com")
+	soa = append(soa, rname...)
+	for _, n := range []uint32{2024010101, 7200, 3600, 1209600, 300} {
+		soa = binary.BigEndian.AppendUint32(soa, n)
+	}
+	tests := []struct {
+		name  string
+		typ   DnsType
+		rdata []byte
+		want  interface{}
+		err   error
+	}{
+		{"MX", RR_MX, append([]byte{0, 10}, name...), DnsMx{10, "mail.example.com"}, nil},
+		{"MX without preference", RR_MX, []byte{0}, nil, errFormat},
+		{"SRV without port", RR_SRV, []byte{0, 1, 0, 2}, nil, errFormat},
+		{"HINFO", RR_HINFO, []byte{3, 'a', 'r', 'm', 5, 'l', 'i', 'n', 'u', 'x'}, "arm", nil},
+		{"HINFO past rdata", RR_HINFO, []byte{9, 'a', 'r', 'm'}, nil, errFormat},
+		{"TXT", RR_TXT, []byte{4, 't', 'e', 's', 't'}, "test", nil},
+		{"TXT of several strings", RR_TXT, []byte{2, 'v', '=', 0, 3, 's', 'p', 'f'}, "v=spf", nil},
+		{"TXT second string past rdata", RR_TXT, []byte{1, 'v', 4, 's'}, nil, errFormat},
+		{"empty TXT", RR_TXT, []byte{}, nil, errFormat},
+		{"AFSDB without subtype", RR_AFSDB, []byte{1}, nil, errFormat},
+		{"LOC without size", RR_LOC, []byte{0}, nil, errFormat},
+		{"NAPTR", RR_NAPTR, append([]byte{0, 1, 0, 2, 1, 'u', 3, 'E', '2', 'U', 0}, name...),
+			DnsNaptr{1, 2, "u", "E2U", "", "mail.example.com"}, nil},
+		{"NAPTR without strings", RR_NAPTR, []byte{0, 1, 0, 2}, nil, errFormat},
+		{"NAPTR service past rdata", RR_NAPTR, []byte{0, 1, 0, 2, 1, 'u', 7, 'E'}, nil, errFormat},
+		{"SOA", RR_SOA, soa, DnsSoa{"ns.example.com", "hostmaster.example.com", 2024010101, 7200, 3600, 1209600, 300}, nil},
+		{"SOA without minimum", RR_SOA, soa[:len(soa)-4], nil, errFormat},
+		{"unknown type", 99, []byte{1, 2, 3}, DnsUnknown{99, []byte{1, 2, 3}}, nil},
+	}
+	for _, tt := range tests {
+		msg, err := ParseMessage(responseWithRR(t, tt.typ, tt.rdata))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(msg.Answer[0].Data, tt.want) {
+			t.Errorf("%v: %#v, want %#v", tt.name, msg.Answer[0].Data, tt.want)
+		}
+	}
+}
+
+// обрезанное в любом месте сообщение дает ошибку, а не панику
+func TestParseMessageTruncated(t *testing.T) {
+	q, err := makeQuery(RR_NS, "example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := testResponse(t, q, 0, []testRR{
+		{"example.com", RR_NS, 60, "ns.example.com"},
+		{"example.com", RR_TXT, 60, "v=spf1 -all"},
+		{"ns.example.com", RR_A, 60, "192.0.2.53"},
+	}, nil)
+	if _, err := ParseMessage(full); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(full); n++ {
+		if _, err := ParseMessage(full[:n]); err == nil {
+			t.Errorf("no error for %v of %v bytes", n, len(full))
+		}
+	}
+}
+
+func TestParseQuestionBadName(t *testing.T) {
+	tests := []struct {
+		name     string
+		question []byte
+	}{
+		{"pointer before question", []byte{0xc0, 0x01, 0, 1, 0, 1}},
+		{"label past message", []byte{7, 'e', 'x'}},
+		{"bad compression mask", []byte{0x80, 0x0c, 0, 1, 0, 1}},
+	}
+	for _, tt := range tests {
+		data := make([]byte, headerLen)
+		binary.BigEndian.PutUint16(data[4:], 1)
+		if _, err := ParseMessage(append(data, tt.question...)); err == nil {
+			t.Errorf("%v: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package awesomedns
+
+// счетчики и гистограмма времени ответа по серверам в текстовом формате prometheus
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// границы корзин гистограммы времени ответа, секунды
+var rttBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var rcodeNames = map[uint8]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// Metrics для Config.Metrics. http.Handler, отдает метрики в формате prometheus.
+// один на несколько Config, счетчики ведутся по имени сервера
+type Metrics struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamMetrics
+}
+
+type upstreamMetrics struct {
+	queries      uint64
+	rcodes       map[uint8]uint64
+	timeouts     uint64
+	retries      uint64
+	truncated    uint64
+	tcpFallbacks uint64
+	rttBuckets   []uint64
+	rttSum       float64
+	rttCount     uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{upstreams: map[string]*upstreamMetrics{}}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo пишет все метрики в текстовом формате prometheus
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.upstreams))
+	for name := range m.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var bw strings.Builder
+	counters := []struct {
+		name, help string
+		value      func(*upstreamMetrics) uint64
+	}{
+		{"awesomedns_queries_total", "Queries sent to upstream.", func(u *upstreamMetrics) uint64 { return u.queries }},
+		{"awesomedns_timeouts_total", "Queries without response in time.", func(u *upstreamMetrics) uint64 { return u.timeouts }},
+		{"awesomedns_retries_total", "Queries repeated after upstream failure.", func(u *upstreamMetrics) uint64 { return u.retries }},
+		{"awesomedns_truncated_total", "Truncated responses.", func(u *upstreamMetrics) uint64 { return u.truncated }},
+		{"awesomedns_tcp_fallbacks_total", "Queries repeated over TCP after truncated UDP response.", func(u *upstreamMetrics) uint64 { return u.tcpFallbacks }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(&bw, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+		for _, name := range names {
+			fmt.Fprintf(&bw, "%v{upstream=\"%v\"} %v\n", c.name, escapeLabelValue(name), c.value(m.upstreams[name]))
+		}
+	}
+	fmt.Fprintf(&bw, "# HELP awesomedns_responses_total Responses by RCODE.\n# TYPE awesomedns_responses_total counter\n")
+	for _, name := range names {
+		u := m.upstreams[name]
+		rcodes := make([]int, 0, len(u.rcodes))
+		for rcode := range u.rcodes {
+			rcodes = append(rcodes, int(rcode))
+		}
+		sort.Ints(rcodes)
+		for _, rcode := range rcodes {
+			fmt.Fprintf(&bw, "awesomedns_responses_total{upstream=\"%v\",rcode=\"%v\"} %v\n", escapeLabelValue(name), rcodeName(uint8(rcode)), u.rcodes[uint8(rcode)])
+		}
+	}
+	fmt.Fprintf(&bw, "# HELP awesomedns_rtt_seconds Upstream response time.\n# TYPE awesomedns_rtt_seconds histogram\n")
+	for _, name := range names {
+		u := m.upstreams[name]
+		label := escapeLabelValue(name)
+		var cumulative uint64
+		for i, le := range rttBuckets {
+			cumulative += u.rttBuckets[i]
+			fmt.Fprintf(&bw, "awesomedns_rtt_seconds_bucket{upstream=\"%v\",le=\"%v\"} %v\n", label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&bw, "awesomedns_rtt_seconds_bucket{upstream=\"%v\",le=\"+Inf\"} %v\n", label, u.rttCount)
+		fmt.Fprintf(&bw, "awesomedns_rtt_seconds_sum{upstream=\"%v\"} %v\n", label, strconv.FormatFloat(u.rttSum, 'g', -1, 64))
+		fmt.Fprintf(&bw, "awesomedns_rtt_seconds_count{upstream=\"%v\"} %v\n", label, u.rttCount)
+	}
+	n, err := io.WriteString(w, bw.String())
+	return int64(n), err
+}
+
+func rcodeName(rcode uint8) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(int(rcode))
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// upstream счетчики сервера, вызывается под m.mu
+func (m *Metrics) upstream(name string) *upstreamMetrics {
+	if m.upstreams == nil {
+		m.upstreams = map[string]*upstreamMetrics{}
+	}
+	u, ok := m.upstreams[name]
+	if !ok {
+		u = &upstreamMetrics{rcodes: map[uint8]uint64{}, rttBuckets: make([]uint64, len(rttBuckets))}
+		m.upstreams[name] = u
+	}
+	return u
+}
+
+func (m *Metrics) add(name string, update func(u *upstreamMetrics)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(m.upstream(name))
+}
+
+func (m *Metrics) query(name string) {
+	m.add(name, func(u *upstreamMetrics) { u.queries++ })
+}
+
+// response код ответа и время от отправки запроса
+func (m *Metrics) response(name string, response []byte, rtt time.Duration) {
+	if len(response) < headerLen {
+		return
+	}
+	m.add(name, func(u *upstreamMetrics) {
+		u.rcodes[response[3]&0b1111]++
+		seconds := rtt.Seconds()
+		for i, le := range rttBuckets {
+			if seconds <= le {
+				u.rttBuckets[i]++
+				break
+			}
+		}
+		u.rttSum += seconds
+		u.rttCount++
+	})
+}
+
+func (m *Metrics) timeout(name string) {
+	m.add(name, func(u *upstreamMetrics) { u.timeouts++ })
+}
+
+func (m *Metrics) retry(name string) {
+	m.add(name, func(u *upstreamMetrics) { u.retries++ })
+}
+
+func (m *Metrics) truncated(name string) {
+	m.add(name, func(u *upstreamMetrics) { u.truncated++ })
+}
+
+func (m *Metrics) tcpFallback(name string) {
+	m.add(name, func(u *upstreamMetrics) { u.tcpFallbacks++ })
+}
+
+// wrap транспорт, который считает запросы, ответы и таймауты сервера name
+func (m *Metrics) wrap(name string, transport Transport) Transport {
+	if m == nil {
+		return transport
+	}
+	return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		m.query(name)
+		sent := time.Now()
+		response, err := transport.Exchange(ctx, q)
+		if err != nil {
+			if isTimeout(err) {
+				m.timeout(name)
+			}
+			return nil, err
+		}
+		m.response(name, response, time.Since(sent))
+		return response, nil
+	})
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
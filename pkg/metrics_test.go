@@ -0,0 +1,148 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// truncatingServer по udp отвечает пустым ответом с TC через udpDelay,
+// по tcp на том же порту - адресом 192.0.2.1 через tcpDelay
+func truncatingServer(t *testing.T, udpDelay, tcpDelay time.Duration) string {
+	t.Helper()
+	var l net.Listener
+	var pc net.PacketConn
+	for i := 0; pc == nil; i++ {
+		var err error
+		if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if pc, err = net.ListenPacket("udp", l.Addr().String()); err != nil {
+			l.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	serveUDP(t, pc, func(q []byte) []byte {
+		time.Sleep(udpDelay)
+		res := testResponse(t, q, 0, nil, nil)
+		res[2] |= 0b10
+		return res
+	})
+	serveTCP(t, l, func(q []byte) []byte {
+		time.Sleep(tcpDelay)
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	})
+	return l.Addr().String()
+}
+
+// повтор по tcp после обрезанного ответа получает свой таймаут tcp,
+// а не остаток таймаута udp
+func TestTruncatedFallbackTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		tcpTimeout time.Duration
+		call       time.Duration // tcp таймаут из WithTimeouts
+		tcpDelay   time.Duration
+		err        error
+	}{
+		{"own tcp timeout", time.Second, 0, 150 * time.Millisecond, nil},
+		{"tcp timeout applies", 100 * time.Millisecond, 0, 400 * time.Millisecond, context.DeadlineExceeded},
+		{"per call tcp timeout", 50 * time.Millisecond, time.Second, 150 * time.Millisecond, nil},
+	}
+	for _, tt := range tests {
+		server := truncatingServer(t, 150*time.Millisecond, tt.tcpDelay)
+		r := NewResolver(Config{Server: server, UDPTimeout: 200 * time.Millisecond, TCPTimeout: tt.tcpTimeout})
+		ips, err := r.ResolveA(WithTimeouts(context.Background(), 0, tt.call), "example.com")
+		if !errors.Is(err, tt.err) || tt.err == nil && (err != nil || len(ips) != 1) {
+			t.Errorf("%v: %v, %v, want %v", tt.name, ips, err, tt.err)
+		}
+	}
+}
+
+// метрики в формате prometheus сверяются с testdata/metrics.golden
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	response := func(rcode byte) []byte {
+		res := make([]byte, headerLen)
+		res[2], res[3] = 0b1000_0000, 0b1000_0000|rcode
+		return res
+	}
+	// имя с символами, которые надо экранировать в значении метки
+	odd := "dns \"odd\"\\\nname"
+	m.query("192.0.2.1:53")
+	m.query("192.0.2.1:53")
+	m.query("192.0.2.1:53")
+	m.response("192.0.2.1:53", response(0), 62500*time.Microsecond)
+	m.response("192.0.2.1:53", response(3), 500*time.Millisecond)
+	m.response("192.0.2.1:53", response(9), 32*time.Second)
+	m.timeout("192.0.2.1:53")
+	m.retry("192.0.2.1:53")
+	m.truncated(odd)
+	m.tcpFallback(odd)
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "metrics.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != string(golden) {
+		t.Errorf("metrics:\n%v\nwant:\n%v", b.String(), string(golden))
+	}
+}
+
+func TestMetricsResolve(t *testing.T) {
+	servfail, _ := countingServer(t, 2)
+	truncating := truncatingServer(t, 0, 0)
+	silent, _ := countingServer(t, -1)
+	m := NewMetrics()
+	if _, err := ResolveA("example.com", Config{Server: servfail, Servers: []string{truncating}, Metrics: m}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveA("example.com", Config{Server: silent, Metrics: m, UDPTimeout: 50 * time.Millisecond}); err == nil {
+		t.Fatal("silent server answered")
+	}
+	if res, err := MegaBulkResolveA([]string{"a.example", "b.example"}, Config{Server: servfail, Metrics: m}); err != nil || len(res) != 2 {
+		t.Fatalf("MegaBulkResolveA = %v, %v", res, err)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("Content-Type %q", ct)
+	}
+	for _, want := range []string{
+		`awesomedns_queries_total{upstream="` + servfail + `"} 3`,
+		`awesomedns_retries_total{upstream="` + servfail + `"} 1`,
+		`awesomedns_responses_total{upstream="` + servfail + `",rcode="SERVFAIL"} 3`,
+		`awesomedns_queries_total{upstream="` + truncating + `"} 1`,
+		`awesomedns_truncated_total{upstream="` + truncating + `"} 1`,
+		`awesomedns_tcp_fallbacks_total{upstream="` + truncating + `"} 1`,
+		`awesomedns_responses_total{upstream="` + truncating + `",rcode="NOERROR"} 1`,
+		`awesomedns_timeouts_total{upstream="` + silent + `"} 1`,
+		`awesomedns_rtt_seconds_count{upstream="` + silent + `"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("no %v in\n%v", want, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.query("x")
+	m.response("x", make([]byte, headerLen), time.Millisecond)
+	m.timeout("x")
+	transport := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) { return nil, nil })
+	if _, ok := m.wrap("x", transport).(TransportFunc); !ok {
+		t.Error("nil Metrics wraps transport")
+	}
+}
@@ -0,0 +1,158 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// traceMiddleware пишет в trace имя до и после обмена
+func traceMiddleware(mu *sync.Mutex, trace *[]string, name string) Middleware {
+	return func(next Transport) Transport {
+		return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			mu.Lock()
+			*trace = append(*trace, name+">")
+			mu.Unlock()
+			res, err := next.Exchange(ctx, q)
+			mu.Lock()
+			*trace = append(*trace, "<"+name)
+			mu.Unlock()
+			return res, err
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	transport, _ := fakeTransport(t, 0, testRR{"", RR_A, 60, "192.0.2.1"})
+	base := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		mu.Lock()
+		trace = append(trace, "transport")
+		mu.Unlock()
+		return transport.Exchange(ctx, q)
+	})
+	config := Config{Transport: base, Middleware: []Middleware{
+		traceMiddleware(&mu, &trace, "a"),
+		traceMiddleware(&mu, &trace, "b"),
+	}}
+	if _, err := ResolveA("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	// первый в списке - внешний
+	want := []string{"a>", "b>", "transport", "<b", "<a"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("trace %v, want %v", trace, want)
+	}
+	if got := Chain(base); got == nil {
+		t.Error("Chain without middleware")
+	}
+}
+
+// middleware оборачивает каждый обмен: каждый сервер при переходе, каждый шаг
+// итеративного разрешения и каждый запрос массовых режимов
+func TestMiddlewareEveryUpstream(t *testing.T) {
+	servfail, _ := countingServer(t, 2)
+	ok, _ := countingServer(t, 0)
+	tests := []struct {
+		name    string
+		config  func() (Config, func() int) // конфиг и ожидаемое число обменов
+		resolve func(config Config) error
+	}{
+		{"failover", func() (Config, func() int) {
+			return Config{Server: servfail, Servers: []string{ok}}, func() int { return 2 }
+		}, func(config Config) error {
+			_, err := ResolveA("example.com", config)
+			return err
+		}},
+		{"iterative", func() (Config, func() int) {
+			it, queries := testIterator(t)
+			return Config{Iterative: it}, func() int { return len(queries()) }
+		}, func(config Config) error {
+			_, err := ResolveA("www.example.com", config)
+			return err
+		}},
+		{"BulkResolveA", func() (Config, func() int) {
+			return Config{Server: ok}, func() int { return 3 }
+		}, func(config Config) error {
+			_, err := BulkResolveA([]string{"a.example", "b.example", "c.example"}, config)
+			return err
+		}},
+		{"MegaBulkResolveA", func() (Config, func() int) {
+			return Config{Server: ok}, func() int { return 3 }
+		}, func(config Config) error {
+			res, err := MegaBulkResolveA([]string{"a.example", "b.example", "c.example"}, config)
+			if err == nil && len(res["b.example"].Ips) != 1 {
+				return errors.New("no answer for b.example")
+			}
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		var calls atomic.Int32
+		config, want := tt.config()
+		config.Middleware = []Middleware{func(next Transport) Transport {
+			return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+				calls.Add(1)
+				return next.Exchange(ctx, q)
+			})
+		}}
+		if err := tt.resolve(config); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		if n := int(calls.Load()); n != want() || n == 0 {
+			t.Errorf("%v: middleware saw %v exchanges, want %v", tt.name, n, want())
+		}
+	}
+}
+
+// ответ middleware сверяется с исходным запросом, а не с тем, что ушло дальше
+func TestMiddlewareVerification(t *testing.T) {
+	transport, queries := fakeTransport(t, 0, testRR{"", RR_A, 60, "192.0.2.1"})
+	tests := []struct {
+		name       string
+		middleware Middleware
+		err        error
+	}{
+		{"pass through", func(next Transport) Transport { return next }, nil},
+		// отвечает сам, не спрашивая сервер
+		{"block", func(next Transport) Transport {
+			return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+				return testResponse(t, q, 3, nil, nil), nil
+			})
+		}, errNameError},
+		{"wrong id", func(next Transport) Transport {
+			return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+				res, err := next.Exchange(ctx, q)
+				if err == nil {
+					res[0] ^= 0xff
+				}
+				return res, err
+			})
+		}, errResponseMismatch},
+		// подменил имя в запросе и не вернул его в ответе
+		{"rewritten name", func(next Transport) Transport {
+			return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+				other, err := makeQuery(RR_A, "other.example", 1)
+				if err != nil {
+					return nil, err
+				}
+				copy(other, q[:2])
+				return next.Exchange(ctx, other)
+			})
+		}, errResponseMismatch},
+	}
+	for _, tt := range tests {
+		config := Config{Transport: transport, Middleware: []Middleware{tt.middleware}}
+		ips, err := ResolveA("example.com", config)
+		if !errors.Is(err, tt.err) || tt.err == nil && (err != nil || len(ips) != 1) {
+			t.Errorf("%v: %v, %v, want %v", tt.name, ips, err, tt.err)
+		}
+	}
+	if n := len(queries()); n != 3 {
+		t.Errorf("%v queries reached the transport, want 3", n)
+	}
+}
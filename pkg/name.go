@@ -0,0 +1,278 @@
+package awesomedns
+
+// доменное имя по rfc1035 и rfc4343 (экранирование \. и \DDD в текстовом виде)
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errEmptyName  = errors.New("empty name")
+	errEmptyLabel = errors.New("empty label")
+	errBadEscape  = errors.New("bad escape sequence")
+)
+
+// Name доменное имя. метки хранятся как есть, без экранирования, слева направо.
+// корень - имя без меток
+type Name struct {
+	labels []string
+}
+
+// RootName корень "."
+var RootName = Name{}
+
+// ParseName разбирает имя в текстовом виде. точка в конце не обязательна
+func ParseName(s string) (Name, error) {
+	var n Name
+	if s == "" {
+		return n, errEmptyName
+	}
+	if s == "." {
+		return n, nil
+	}
+	var label []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '.':
+			if len(label) == 0 {
+				return Name{}, fmt.Errorf("%w in %q", errEmptyLabel, s)
+			}
+			n.labels = append(n.labels, string(label))
+			label = label[:0]
+		case '\\':
+			if i+1 >= len(s) {
+				return Name{}, fmt.Errorf("%w in %q", errBadEscape, s)
+			}
+			if isDigit(s[i+1]) {
+				if i+3 >= len(s) || !isDigit(s[i+2]) || !isDigit(s[i+3]) {
+					return Name{}, fmt.Errorf("%w in %q", errBadEscape, s)
+				}
+				v, _ := strconv.Atoi(s[i+1 : i+4])
+				if v > 255 {
+					return Name{}, fmt.Errorf("%w in %q", errBadEscape, s)
+				}
+				label = append(label, byte(v))
+				i += 3
+			} else {
+				label = append(label, s[i+1])
+				i++
+			}
+		default:
+			label = append(label, c)
+		}
+		if len(label) > MaxLabelLen {
+			return Name{}, fmt.Errorf("label in %q is too long %v > %v", s, len(label), MaxLabelLen)
+		}
+	}
+	if len(label) > 0 {
+		n.labels = append(n.labels, string(label))
+	}
+	if n.WireLen() > MaxNameLen {
+		return Name{}, fmt.Errorf("name %q is too long %v > %v", s, n.WireLen(), MaxNameLen)
+	}
+	return n, nil
+}
+
+// NameFromLabels собирает имя из меток без экранирования
+func NameFromLabels(labels ...string) (Name, error) {
+	n := Name{labels: append([]string(nil), labels...)}
+	for _, label := range labels {
+		if label == "" {
+			return Name{}, errEmptyLabel
+		}
+		if len(label) > MaxLabelLen {
+			return Name{}, fmt.Errorf("label is too long %v > %v", len(label), MaxLabelLen)
+		}
+	}
+	if n.WireLen() > MaxNameLen {
+		return Name{}, fmt.Errorf("name is too long %v > %v", n.WireLen(), MaxNameLen)
+	}
+	return n, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// String текстовый вид без завершающей точки, для корня "."
+func (n Name) String() string {
+	if n.IsRoot() {
+		return "."
+	}
+	escaped := make([]string, len(n.labels))
+	for i, label := range n.labels {
+		escaped[i] = escapeLabel(label)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// FQDN текстовый вид с завершающей точкой
+func (n Name) FQDN() string {
+	if n.IsRoot() {
+		return "."
+	}
+	return n.String() + "."
+}
+
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';' || c == '@' || c == '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x21 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (n Name) IsRoot() bool {
+	return len(n.labels) == 0
+}
+
+// Labels метки слева направо без экранирования
+func (n Name) Labels() []string {
+	return append([]string(nil), n.labels...)
+}
+
+func (n Name) NumLabels() int {
+	return len(n.labels)
+}
+
+// Parent имя без первой метки. у корня родителя нет
+func (n Name) Parent() (Name, bool) {
+	if n.IsRoot() {
+		return n, false
+	}
+	return Name{labels: n.labels[1:]}, true
+}
+
+// Ancestors само имя и все родители до корня включительно
+func (n Name) Ancestors() []Name {
+	res := make([]Name, 0, len(n.labels)+1)
+	for i := 0; i <= len(n.labels); i++ {
+		res = append(res, Name{labels: n.labels[i:]})
+	}
+	return res
+}
+
+// WireLen длина в формате сообщения, включая нулевую метку корня
+func (n Name) WireLen() int {
+	length := 1
+	for _, label := range n.labels {
+		length += len(label) + 1
+	}
+	return length
+}
+
+func (n Name) appendWire(b []byte) []byte {
+	for _, label := range n.labels {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// Lower имя в нижнем регистре (только ascii, rfc4343)
+func (n Name) Lower() Name {
+	res := Name{labels: make([]string, len(n.labels))}
+	for i, label := range n.labels {
+		res.labels[i] = lowerASCII(label)
+	}
+	return res
+}
+
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// Equal сравнение без учета регистра
+func (n Name) Equal(other Name) bool {
+	if len(n.labels) != len(other.labels) {
+		return false
+	}
+	for i := range n.labels {
+		if !equalFoldASCII(n.labels[i], other.labels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFoldASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if lowerByte(a[i]) != lowerByte(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// IsSubdomain true если имя совпадает с parent или находится под ним
+func (n Name) IsSubdomain(parent Name) bool {
+	if len(n.labels) < len(parent.labels) {
+		return false
+	}
+	return Name{labels: n.labels[len(n.labels)-len(parent.labels):]}.Equal(parent)
+}
+
+// Compare канонический порядок rfc4034 6.1: метки сравниваются справа налево
+// побайтно в нижнем регистре, более короткое имя идет раньше
+func (n Name) Compare(other Name) int {
+	i, j := len(n.labels)-1, len(other.labels)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		a, b := n.labels[i], other.labels[j]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			ca, cb := lowerByte(a[k]), lowerByte(b[k])
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+		}
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case i < 0 && j < 0:
+		return 0
+	case i < 0:
+		return -1
+	default:
+		return 1
+	}
+}
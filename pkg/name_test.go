@@ -0,0 +1,149 @@
+package awesomedns
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		in     string
+		labels []string
+		str    string
+		err    error
+	}{
+		{".", nil, ".", nil},
+		{"example.com", []string{"example", "com"}, "example.com", nil},
+		{"Example.COM.", []string{"Example", "COM"}, "Example.COM", nil},
+		{`a\.b.example`, []string{"a.b", "example"}, `a\.b.example`, nil},
+		{`\065\066.example`, []string{"AB", "example"}, "AB.example", nil},
+		{`a\032b.example`, []string{"a b", "example"}, `a\032b.example`, nil},
+		{`back\\slash.example`, []string{`back\slash`, "example"}, `back\\slash.example`, nil},
+		{`\000.example`, []string{"\x00", "example"}, `\000.example`, nil},
+		{"", nil, "", errEmptyName},
+		{"a..b", nil, "", errEmptyLabel},
+		{".example", nil, "", errEmptyLabel},
+		{`a\`, nil, "", errBadEscape},
+		{`a\25`, nil, "", errBadEscape},
+		{`a\256`, nil, "", errBadEscape},
+	}
+	for _, tt := range tests {
+		n, err := ParseName(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("ParseName(%q) err = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(n.Labels(), tt.labels) {
+			t.Errorf("ParseName(%q) labels = %q, want %q", tt.in, n.Labels(), tt.labels)
+		}
+		if n.String() != tt.str {
+			t.Errorf("ParseName(%q).String() = %q, want %q", tt.in, n.String(), tt.str)
+		}
+		again, err := ParseName(n.String())
+		if err != nil || !again.Equal(n) {
+			t.Errorf("ParseName(%q) does not round-trip: %q, %v", tt.in, again, err)
+		}
+	}
+}
+
+func TestParseNameLimits(t *testing.T) {
+	label63 := strings.Repeat("a", MaxLabelLen)
+	tests := []struct {
+		name string
+		in   string
+		ok   bool
+	}{
+		{"label of 63", label63 + ".example", true},
+		{"label of 64", label63 + "a.example", false},
+		// 4 метки по 63 и длины меток с корнем дают 256 байт
+		{"name of 256 bytes", strings.Repeat(label63+".", 4), false},
+		{"name of 255 bytes", strings.Repeat(label63+".", 3) + strings.Repeat("a", 61), true},
+		{"escaped label of 63", strings.Repeat(`\097`, MaxLabelLen), true},
+	}
+	for _, tt := range tests {
+		_, err := ParseName(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestNameRelations(t *testing.T) {
+	mustParse := func(s string) Name {
+		n, err := ParseName(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tests := []struct {
+		a, b      string
+		equal     bool
+		subdomain bool
+	}{
+		{"www.Example.com", "WWW.example.COM.", true, true},
+		{"www.example.com", "example.com", false, true},
+		{"example.com", "www.example.com", false, false},
+		{"www.example.com", ".", false, true},
+		{"wwwexample.com", "example.com", false, false},
+		{`a\.b.com`, "b.com", false, false},
+	}
+	for _, tt := range tests {
+		a, b := mustParse(tt.a), mustParse(tt.b)
+		if a.Equal(b) != tt.equal {
+			t.Errorf("%q.Equal(%q) = %v", tt.a, tt.b, !tt.equal)
+		}
+		if a.IsSubdomain(b) != tt.subdomain {
+			t.Errorf("%q.IsSubdomain(%q) = %v", tt.a, tt.b, !tt.subdomain)
+		}
+	}
+}
+
+// порядок из примера rfc4034 6.1
+func TestNameCompare(t *testing.T) {
+	ordered := []string{
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"Z.a.example",
+		"zABC.a.EXAMPLE",
+		"z.example",
+		`\001.z.example`,
+		"*.z.example",
+		`\200.z.example`,
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := ParseName(ordered[i])
+			b, _ := ParseName(ordered[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("Compare(%q, %q) = %v, want %v", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+}
+
+func TestNameWire(t *testing.T) {
+	q, err := makeQuery(RR_A, `a\.b.example`, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, read, err := readName(q[headerLen:], map[int]string{}, headerLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != `a\.b.example` || read != 1+3+1+7+1 {
+		t.Errorf("readName = %q, %v", name, read)
+	}
+}
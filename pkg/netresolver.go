@@ -0,0 +1,299 @@
+package awesomedns
+
+// методы с сигнатурами net.Resolver, чтобы Resolver можно было подставить вместо него,
+// и Dial, чтобы стандартный net.Resolver ходил через транспорты этого пакета
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const errNoSuchHost = "no such host"
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+// LookupIPAddr адреса ipv4, затем ipv6. ошибка только если не нашлось ни тех, ни других
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []net.IPAddr{{IP: ip.AsSlice(), Zone: ip.Zone()}}, nil
+	}
+	v4, err4 := r.ResolveA(ctx, host)
+	v6, err6 := r.ResolveAaaa(ctx, host)
+	var res []net.IPAddr
+	for _, ip := range append(v4, v6...) {
+		res = append(res, net.IPAddr{IP: ip})
+	}
+	if len(res) == 0 {
+		return nil, r.dnsError(errors.Join(err4, err6), host)
+	}
+	return res, nil
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.ResolveMx(ctx, name)
+	if err != nil || len(records) == 0 {
+		return nil, r.dnsError(err, name)
+	}
+	res := make([]*net.MX, len(records))
+	for i, mx := range records {
+		res[i] = &net.MX{Host: fqdn(mx.Exchange), Pref: mx.Preference}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Pref < res[j].Pref })
+	return res, nil
+}
+
+// LookupSRV как net.Resolver: при пустых service и proto спрашивается name как есть
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	res, err := r.Lookup(ctx, RR_SRV, target)
+	if err != nil || len(res.Records) == 0 {
+		return "", nil, r.dnsError(err, target)
+	}
+	var addrs []*net.SRV
+	for _, v := range res.Records {
+		if srv, ok := v.(DnsSRV); ok {
+			addrs = append(addrs, &net.SRV{Target: fqdn(srv.Target), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		if addrs[i].Priority != addrs[j].Priority {
+			return addrs[i].Priority < addrs[j].Priority
+		}
+		return addrs[i].Weight > addrs[j].Weight
+	})
+	return fqdn(res.Canonical), addrs, nil
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	res, err := r.Lookup(ctx, RR_TXT, name)
+	if err != nil || len(res.Records) == 0 {
+		return nil, r.dnsError(err, name)
+	}
+	var txts []string
+	for _, v := range res.Records {
+		if txt, ok := v.(string); ok {
+			txts = append(txts, txt)
+		}
+	}
+	return txts, nil
+}
+
+// LookupAddr имена для адреса по PTR, с учетом hosts
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	names, err := r.ResolvePtrAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return nil, r.dnsError(err, addr)
+	}
+	for i := range names {
+		names[i] = fqdn(names[i])
+	}
+	return names, nil
+}
+
+// LookupCNAME каноническое имя после CNAME и DNAME. имя без CNAME - само себе каноническое
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	res, err := r.Lookup(ctx, RR_A, host)
+	if err != nil {
+		return "", r.dnsError(err, host)
+	}
+	return fqdn(res.Canonical), nil
+}
+
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	records, err := r.ResolveNs(ctx, name)
+	if err != nil || len(records) == 0 {
+		return nil, r.dnsError(err, name)
+	}
+	res := make([]*net.NS, len(records))
+	for i, ns := range records {
+		res[i] = &net.NS{Host: fqdn(ns)}
+	}
+	return res, nil
+}
+
+// dnsError ошибка в виде *net.DNSError, как у net.Resolver. nil err - ответ без данных
+func (r *Resolver) dnsError(err error, name string) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr
+	}
+	dnsErr = &net.DNSError{Err: errNoSuchHost, Name: name, Server: r.config.Server, IsNotFound: true}
+	if err == nil || errors.Is(err, errNameError) {
+		return dnsErr
+	}
+	var netErr net.Error
+	dnsErr.Err = err.Error()
+	dnsErr.IsNotFound = false
+	dnsErr.IsTimeout = errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	dnsErr.IsTemporary = dnsErr.IsTimeout || errors.Is(err, errServFail)
+	return dnsErr
+}
+
+func fqdn(name string) string {
+	if name == "" || isFQDN(name) {
+		return name
+	}
+	return name + "."
+}
+
+// Dial для net.Resolver.Dial вместе с PreferGo: запросы стандартного резолвера идут
+// через серверы и транспорты config, адрес из resolv.conf не используется.
+// обмен происходит во время Write, Read отдает готовый ответ. соединение не
+// net.PacketConn, поэтому net.Resolver и для udp пишет сообщения с длиной, как в tcp,
+// а как на самом деле отправить запрос, решает config
+func (r *Resolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if r.config.Iterative == nil && len(r.config.upstreams()) == 0 {
+		return nil, errNoServers
+	}
+	return &dialConn{config: r.config, network: network, address: address}, nil
+}
+
+type dialAddr struct {
+	network, address string
+}
+
+func (a dialAddr) Network() string { return a.network }
+func (a dialAddr) String() string  { return a.address }
+
+// dialConn соединение в памяти с сообщениями в формате tcp
+type dialConn struct {
+	config  Config
+	network string
+	address string
+
+	mu       sync.Mutex
+	deadline time.Time
+	written  bytes.Buffer
+	read     bytes.Buffer
+	closed   bool
+}
+
+func (c *dialConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	deadline := c.deadline
+	var queries [][]byte
+	c.written.Write(b)
+	for c.written.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.written.Bytes()))
+		if c.written.Len() < 2+size {
+			break
+		}
+		c.written.Next(2)
+		queries = append(queries, append([]byte(nil), c.written.Next(size)...))
+	}
+	c.mu.Unlock()
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	for _, q := range queries {
+		response, err := c.exchange(ctx, q)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return 0, os.ErrDeadlineExceeded
+			}
+			return 0, err
+		}
+		c.mu.Lock()
+		c.read.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+		c.read.Write(response)
+		c.mu.Unlock()
+	}
+	return len(b), nil
+}
+
+// exchange как в resolve: итеративно или по серверам с Attempts и Rotate
+func (c *dialConn) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	if c.config.Iterative == nil {
+		return resolveUpstreams(ctx, func() ([]byte, error) { return q, nil }, c.config)
+	}
+	msg, err := ParseMessage(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Question) != 1 {
+		return nil, errFormat
+	}
+	response, err := c.config.Iterative.lookup(ctx, msg.Question[0].Type, msg.Question[0].Name, c.config, 0)
+	if err != nil {
+		return nil, err
+	}
+	// ответ на свой запрос итератора, id берется из запроса net.Resolver
+	response = append([]byte(nil), response...)
+	copy(response, q[:2])
+	return response, nil
+}
+
+// Read ответ на записанный запрос. если ответа нет, ждать нечего: сразу таймаут
+func (c *dialConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.read.Len() == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.read.Read(b)
+}
+
+func (c *dialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *dialConn) LocalAddr() net.Addr {
+	return dialAddr{c.network, "awesomedns"}
+}
+
+func (c *dialConn) RemoteAddr() net.Addr {
+	return dialAddr{c.network, c.address}
+}
+
+func (c *dialConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dialConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dialConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
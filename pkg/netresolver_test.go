@@ -0,0 +1,374 @@
+package awesomedns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// netLookuper методы net.Resolver, которые повторяет Resolver
+type netLookuper interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+}
+
+var (
+	_ netLookuper = (*net.Resolver)(nil)
+	_ netLookuper = (*Resolver)(nil)
+)
+
+var netTestZone = []testRR{
+	{"host.example", RR_A, 60, "192.0.2.1"},
+	{"host.example", RR_AAAA, 60, "2001:db8::1"},
+	{"v4.example", RR_A, 60, "192.0.2.2"},
+	{"www.example", RR_CNAME, 60, "host.example"},
+	{"example.com", RR_MX, 60, "20 mx2.example.com"},
+	{"example.com", RR_MX, 60, "10 mx1.example.com"},
+	{"example.com", RR_NS, 60, "ns1.example.com"},
+	{"example.com", RR_NS, 60, "ns2.example.com"},
+	{"example.com", RR_TXT, 60, "v=spf1 -all"},
+	{"_sip._tcp.example.com", RR_SRV, 60, "10 5 5060 b.example.com"},
+	{"_sip._tcp.example.com", RR_SRV, 60, "10 60 5060 a.example.com"},
+	{"_sip._tcp.example.com", RR_SRV, 60, "5 0 5061 c.example.com"},
+	{"1.2.0.192.in-addr.arpa", RR_PTR, 60, "host.example"},
+}
+
+// zoneTransport отвечает записями zone, по CNAME добавляет записи цели. имени нет - NXDOMAIN,
+// servfail.example - SERVFAIL, slow.example ждет конца контекста
+func zoneTransport(t *testing.T, zone []testRR) Transport {
+	return TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil, err
+		}
+		qname, qtype := strings.TrimSuffix(strings.ToLower(msg.Question[0].Name), "."), msg.Question[0].Type
+		switch qname {
+		case "servfail.example":
+			return testResponse(t, q, 2, nil, nil), nil
+		case "slow.example":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var answer []testRR
+		exists := false
+		for name := qname; name != ""; {
+			next := ""
+			for _, rr := range zone {
+				if rr.name != name {
+					continue
+				}
+				exists = true
+				switch {
+				case rr.typ == qtype:
+					answer = append(answer, rr)
+				case rr.typ == RR_CNAME:
+					answer = append(answer, rr)
+					next = rr.data
+				}
+			}
+			name = next
+		}
+		if !exists {
+			return testResponse(t, q, 3, nil, nil), nil
+		}
+		return testResponse(t, q, 0, answer, nil), nil
+	})
+}
+
+func TestNetResolverLookups(t *testing.T) {
+	r := NewResolver(Config{Transport: zoneTransport(t, netTestZone)})
+	ctx := context.Background()
+	mxs := func(res []*net.MX, err error) (string, error) {
+		var s []string
+		for _, mx := range res {
+			s = append(s, fmt.Sprint(mx.Pref, " ", mx.Host))
+		}
+		return strings.Join(s, ", "), err
+	}
+	tests := []struct {
+		name   string
+		lookup func() (string, error)
+		want   string
+	}{
+		{"LookupHost", func() (string, error) {
+			res, err := r.LookupHost(ctx, "host.example")
+			return fmt.Sprint(res), err
+		}, "[192.0.2.1 2001:db8::1]"},
+		{"LookupHost only ipv4", func() (string, error) {
+			res, err := r.LookupHost(ctx, "v4.example")
+			return fmt.Sprint(res), err
+		}, "[192.0.2.2]"},
+		{"LookupHost literal", func() (string, error) {
+			res, err := r.LookupHost(ctx, "fe80::1%lo")
+			return fmt.Sprint(res), err
+		}, "[fe80::1%lo]"},
+		{"LookupIPAddr via CNAME", func() (string, error) {
+			res, err := r.LookupIPAddr(ctx, "www.example")
+			return fmt.Sprint(res), err
+		}, "[{192.0.2.1 } {2001:db8::1 }]"},
+		{"LookupMX sorted", func() (string, error) {
+			return mxs(r.LookupMX(ctx, "example.com"))
+		}, "10 mx1.example.com., 20 mx2.example.com."},
+		{"LookupSRV", func() (string, error) {
+			cname, res, err := r.LookupSRV(ctx, "sip", "tcp", "example.com")
+			var s []string
+			for _, srv := range res {
+				s = append(s, fmt.Sprint(srv.Priority, " ", srv.Weight, " ", srv.Port, " ", srv.Target))
+			}
+			return cname + " " + strings.Join(s, ", "), err
+		}, "_sip._tcp.example.com. 5 0 5061 c.example.com., 10 60 5060 a.example.com., 10 5 5060 b.example.com."},
+		{"LookupSRV without service", func() (string, error) {
+			_, res, err := r.LookupSRV(ctx, "", "", "_sip._tcp.example.com")
+			return fmt.Sprint(len(res)), err
+		}, "3"},
+		{"LookupTXT", func() (string, error) {
+			res, err := r.LookupTXT(ctx, "example.com")
+			return fmt.Sprint(res), err
+		}, "[v=spf1 -all]"},
+		{"LookupAddr", func() (string, error) {
+			res, err := r.LookupAddr(ctx, "192.0.2.1")
+			return fmt.Sprint(res), err
+		}, "[host.example.]"},
+		{"LookupCNAME", func() (string, error) {
+			return r.LookupCNAME(ctx, "www.example")
+		}, "host.example."},
+		{"LookupCNAME without CNAME", func() (string, error) {
+			return r.LookupCNAME(ctx, "host.example")
+		}, "host.example."},
+		{"LookupNS", func() (string, error) {
+			res, err := r.LookupNS(ctx, "example.com")
+			var s []string
+			for _, ns := range res {
+				s = append(s, ns.Host)
+			}
+			return strings.Join(s, ", "), err
+		}, "ns1.example.com., ns2.example.com."},
+	}
+	for _, tt := range tests {
+		got, err := tt.lookup()
+		if err != nil || got != tt.want {
+			t.Errorf("%v: %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestNetResolverErrors(t *testing.T) {
+	r := NewResolver(Config{Transport: zoneTransport(t, netTestZone), UDPTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		lookup   func() error
+		dnsName  string
+		notFound bool
+		timeout  bool
+	}{
+		{"NXDOMAIN", func() error { _, err := r.LookupHost(ctx, "nx.example"); return err }, "nx.example", true, false},
+		// ответ без данных тоже "no such host", как у net.Resolver
+		{"no data", func() error { _, err := r.LookupMX(ctx, "host.example"); return err }, "host.example", true, false},
+		{"no TXT", func() error { _, err := r.LookupTXT(ctx, "v4.example"); return err }, "v4.example", true, false},
+		{"SRV name", func() error { _, _, err := r.LookupSRV(ctx, "ldap", "tcp", "example.com"); return err }, "_ldap._tcp.example.com", true, false},
+		{"no PTR", func() error { _, err := r.LookupAddr(ctx, "192.0.2.9"); return err }, "192.0.2.9", true, false},
+		{"bad address", func() error { _, err := r.LookupAddr(ctx, "host.example"); return err }, "host.example", false, false},
+		{"SERVFAIL", func() error { _, err := r.LookupNS(ctx, "servfail.example"); return err }, "servfail.example", false, false},
+		{"timeout", func() error { _, err := r.LookupCNAME(ctx, "slow.example"); return err }, "slow.example", false, true},
+	}
+	for _, tt := range tests {
+		err := tt.lookup()
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			t.Errorf("%v: %T %v, want *net.DNSError", tt.name, err, err)
+			continue
+		}
+		if dnsErr.Name != tt.dnsName || dnsErr.IsNotFound != tt.notFound || dnsErr.IsTimeout != tt.timeout {
+			t.Errorf("%v: %+v", tt.name, dnsErr)
+		}
+	}
+}
+
+// стандартный net.Resolver ходит через Dial к тем же транспортам
+func TestNetResolverDial(t *testing.T) {
+	r := NewResolver(Config{Transport: zoneTransport(t, netTestZone)})
+	std := &net.Resolver{PreferGo: true, Dial: r.Dial}
+	ctx := context.Background()
+	addrs, err := std.LookupHost(ctx, "host.example.")
+	sort.Strings(addrs)
+	if err != nil || !reflect.DeepEqual(addrs, []string{"192.0.2.1", "2001:db8::1"}) {
+		t.Errorf("LookupHost = %v, %v", addrs, err)
+	}
+	mx, err := std.LookupMX(ctx, "example.com.")
+	if err != nil || len(mx) != 2 || mx[0].Host != "mx1.example.com." {
+		t.Errorf("LookupMX = %v, %v", mx, err)
+	}
+	txt, err := std.LookupTXT(ctx, "example.com.")
+	if err != nil || !reflect.DeepEqual(txt, []string{"v=spf1 -all"}) {
+		t.Errorf("LookupTXT = %v, %v", txt, err)
+	}
+	_, err = std.LookupHost(ctx, "nx.example.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupHost nx = %v", err)
+	}
+}
+
+// dialExchange запрос через соединение от Dial в формате tcp
+func dialExchange(conn net.Conn, q []byte) ([]byte, error) {
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...)); err != nil {
+		return nil, err
+	}
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(size))
+	_, err := io.ReadFull(conn, res)
+	return res, err
+}
+
+// Dial использует те же Attempts, Rotate и переход между серверами, что и resolve
+func TestDialUpstreams(t *testing.T) {
+	const silent = -1
+	tests := []struct {
+		name     string
+		rcodes   []int
+		attempts int
+		rotate   bool
+		queries  int // запросов через Dial
+		err      error
+		want     []int32
+	}{
+		{"failover", []int{2, 0}, 0, false, 1, nil, []int32{1, 1}},
+		{"attempts", []int{2, silent}, 2, false, 1, os.ErrDeadlineExceeded, []int32{2, 2}},
+		{"rotate", []int{0, 0}, 0, true, 4, nil, []int32{2, 2}},
+		{"no rotate", []int{0, 0}, 0, false, 4, nil, []int32{4, 0}},
+	}
+	for _, tt := range tests {
+		var servers []string
+		var counts []*atomic.Int32
+		for _, rcode := range tt.rcodes {
+			server, count := countingServer(t, rcode)
+			servers = append(servers, server)
+			counts = append(counts, count)
+		}
+		r := NewResolver(Config{Servers: servers, Attempts: tt.attempts, Rotate: tt.rotate, UDPTimeout: 100 * time.Millisecond})
+		for i := 0; i < tt.queries; i++ {
+			conn, err := r.Dial(context.Background(), "udp", "192.0.2.53:53")
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := makeQuery(RR_A, "example.com", 100+i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := dialExchange(conn, q)
+			conn.Close()
+			if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+				t.Errorf("%v: err = %v, want %v", tt.name, err, tt.err)
+			}
+			if err == nil && binary.BigEndian.Uint16(res) != uint16(100+i) {
+				t.Errorf("%v: response id %v", tt.name, binary.BigEndian.Uint16(res))
+			}
+		}
+		var got []int32
+		for _, count := range counts {
+			got = append(got, count.Load())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: queries %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDialIterative(t *testing.T) {
+	it, _ := testIterator(t)
+	r := NewResolver(Config{Iterative: it})
+	conn, err := r.Dial(context.Background(), "udp", "192.0.2.53:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	q, err := makeQuery(RR_A, "www.example.com", 4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := dialExchange(conn, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyResponse(q, res, false); err != nil {
+		t.Fatal(err)
+	}
+	ips, _, err := parseDnsAnswer(res, false)
+	if err != nil || len(ips) != 1 || !ips[0].(net.IP).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("answer %v, %v", ips, err)
+	}
+}
+
+func TestDialConn(t *testing.T) {
+	if _, err := NewResolver(Config{}).Dial(context.Background(), "udp", "192.0.2.53:53"); !errors.Is(err, errNoServers) {
+		t.Errorf("Dial without servers: %v", err)
+	}
+	r := NewResolver(Config{Transport: zoneTransport(t, netTestZone)})
+	conn, err := r.Dial(context.Background(), "tcp", "192.0.2.53:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().Network() != "tcp" || conn.RemoteAddr().String() != "192.0.2.53:53" {
+		t.Errorf("RemoteAddr %v", conn.RemoteAddr())
+	}
+	// читать нечего, ждать тоже
+	if _, err := conn.Read(make([]byte, 2)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read before Write: %v", err)
+	}
+	// запрос может прийти по частям
+	q, err := makeQuery(RR_A, "host.example", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...)
+	if n, err := conn.Write(framed[:5]); n != 5 || err != nil {
+		t.Fatalf("partial Write = %v, %v", n, err)
+	}
+	if _, err := conn.Read(make([]byte, 2)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after partial query: %v", err)
+	}
+	if _, err := conn.Write(framed[5:]); err != nil {
+		t.Fatal(err)
+	}
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(conn, res); err != nil || verifyResponse(q, res, false) != nil {
+		t.Errorf("response %v", err)
+	}
+	// дедлайн соединения ограничивает обмен
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	slow, err := makeQuery(RR_A, "slow.example", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialExchange(conn, slow); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("past deadline: %v", err)
+	}
+	conn.Close()
+	if _, err := conn.Write(framed); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close: %v", err)
+	}
+}
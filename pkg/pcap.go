@@ -0,0 +1,574 @@
+package awesomedns
+
+// чтение и запись dns трафика в формате pcap/pcapng
+// читается udp и tcp на 53 порту поверх ethernet, linux sll, loopback и raw ip.
+// фрагментированные ip пакеты пропускаются, tcp собирается в порядке захвата без учета
+// перепосылок и перестановок
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagicMicro   = 0xa1b2c3d4
+	pcapMagicNano    = 0xa1b23c4d
+	pcapngSHB        = 0x0a0d0d0a
+	pcapngIDB        = 1
+	pcapngSPB        = 3
+	pcapngEPB        = 6
+	pcapngByteMagic  = 0x1a2b3c4d
+	pcapMaxBlockSize = 16 * 1024 * 1024
+
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	dnsPort = 53
+)
+
+var errPcapFormat = errors.New("wrong pcap format")
+
+// PcapMessage dns сообщение, извлеченное из захвата
+type PcapMessage struct {
+	Time    time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	TCP     bool
+	Data    []byte
+	Message DnsMessage
+	Err     error // ошибка разбора Data, если есть
+}
+
+type pcapInterface struct {
+	linkType uint16
+	tsUnit   time.Duration // 0 если разрешение не кратно наносекунде
+	tsDiv    uint64        // делитель для разрешения 2^-n
+}
+
+type tcpFlow struct {
+	src, dst netip.AddrPort
+}
+
+type PcapReader struct {
+	Port uint16 // порт dns, по умолчанию 53
+
+	r          io.Reader
+	order      binary.ByteOrder
+	ng         bool
+	interfaces []pcapInterface
+	streams    map[tcpFlow][]byte
+	pending    []PcapMessage
+}
+
+// NewPcapReader определяет формат (pcap или pcapng) по первому блоку
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{Port: dnsPort, r: r, streams: map[tcpFlow][]byte{}}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSHB:
+		pr.ng = true
+		if err := pr.readSectionHeader(); err != nil {
+			return nil, err
+		}
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicro || binary.LittleEndian.Uint32(magic) == pcapMagicNano:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == pcapMagicMicro || binary.BigEndian.Uint32(magic) == pcapMagicNano:
+		pr.order = binary.BigEndian
+	default:
+		return nil, errPcapFormat
+	}
+	if !pr.ng {
+		header := make([]byte, 20)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		iface := pcapInterface{linkType: uint16(pr.order.Uint32(header[16:])), tsUnit: time.Microsecond}
+		if pr.order.Uint32(magic) == pcapMagicNano {
+			iface.tsUnit = time.Nanosecond
+		}
+		pr.interfaces = append(pr.interfaces, iface)
+	}
+	return pr, nil
+}
+
+// Next возвращает следующее dns сообщение. в конце файла io.EOF
+func (pr *PcapReader) Next() (PcapMessage, error) {
+	for len(pr.pending) == 0 {
+		ts, iface, data, err := pr.readPacket()
+		if err != nil {
+			return PcapMessage{}, err
+		}
+		pr.decodePacket(ts, iface, data)
+	}
+	msg := pr.pending[0]
+	pr.pending = pr.pending[1:]
+	return msg, nil
+}
+
+func (pr *PcapReader) readPacket() (time.Time, pcapInterface, []byte, error) {
+	if pr.ng {
+		return pr.readBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		return time.Time{}, pcapInterface{}, nil, err
+	}
+	iface := pr.interfaces[0]
+	sec := pr.order.Uint32(header)
+	frac := pr.order.Uint32(header[4:])
+	inclLen := pr.order.Uint32(header[8:])
+	if inclLen > pcapMaxBlockSize {
+		return time.Time{}, iface, nil, errPcapFormat
+	}
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return time.Time{}, iface, nil, err
+	}
+	ts := time.Unix(int64(sec), int64(frac)*int64(iface.tsUnit))
+	return ts, iface, data, nil
+}
+
+// readSectionHeader читает SHB после уже прочитанного типа блока
+func (pr *PcapReader) readSectionHeader() error {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(pr.r, head); err != nil {
+		return err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(head[4:]) == pcapngByteMagic:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head[4:]) == pcapngByteMagic:
+		pr.order = binary.BigEndian
+	default:
+		return errPcapFormat
+	}
+	blockLen := pr.order.Uint32(head)
+	if blockLen < 12 || blockLen > pcapMaxBlockSize {
+		return errPcapFormat
+	}
+	// остаток блока не нужен. описания интерфейсов действуют в пределах секции
+	if _, err := io.CopyN(io.Discard, pr.r, int64(blockLen-12)); err != nil {
+		return err
+	}
+	pr.interfaces = nil
+	return nil
+}
+
+func (pr *PcapReader) readBlock() (time.Time, pcapInterface, []byte, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(pr.r, head); err != nil {
+			return time.Time{}, pcapInterface{}, nil, err
+		}
+		if binary.BigEndian.Uint32(head) == pcapngSHB {
+			// порядок байт новой секции может отличаться, поэтому длину читаем заново
+			pr.r = io.MultiReader(bytes.NewReader(head[4:]), pr.r)
+			if err := pr.readSectionHeader(); err != nil {
+				return time.Time{}, pcapInterface{}, nil, err
+			}
+			continue
+		}
+		blockType := pr.order.Uint32(head)
+		blockLen := pr.order.Uint32(head[4:])
+		if blockLen < 12 || blockLen%4 != 0 || blockLen > pcapMaxBlockSize {
+			return time.Time{}, pcapInterface{}, nil, errPcapFormat
+		}
+		body := make([]byte, blockLen-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return time.Time{}, pcapInterface{}, nil, err
+		}
+		body = body[:len(body)-4]
+		switch blockType {
+		case pcapngIDB:
+			if len(body) < 8 {
+				return time.Time{}, pcapInterface{}, nil, errPcapFormat
+			}
+			pr.interfaces = append(pr.interfaces, pr.parseInterface(body))
+		case pcapngEPB:
+			if len(body) < 20 {
+				return time.Time{}, pcapInterface{}, nil, errPcapFormat
+			}
+			ifaceId := pr.order.Uint32(body)
+			if int(ifaceId) >= len(pr.interfaces) {
+				return time.Time{}, pcapInterface{}, nil, fmt.Errorf("unknown interface %v", ifaceId)
+			}
+			iface := pr.interfaces[ifaceId]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			capLen := pr.order.Uint32(body[12:])
+			if int(capLen) > len(body)-20 {
+				return time.Time{}, pcapInterface{}, nil, errPcapFormat
+			}
+			return iface.timestamp(ts), iface, body[20 : 20+capLen], nil
+		case pcapngSPB:
+			if len(body) < 4 || len(pr.interfaces) == 0 {
+				return time.Time{}, pcapInterface{}, nil, errPcapFormat
+			}
+			origLen := pr.order.Uint32(body)
+			data := body[4:]
+			if int(origLen) < len(data) {
+				data = data[:origLen]
+			}
+			return time.Time{}, pr.interfaces[0], data, nil
+		}
+	}
+}
+
+func (pr *PcapReader) parseInterface(body []byte) pcapInterface {
+	iface := pcapInterface{linkType: pr.order.Uint16(body), tsUnit: time.Microsecond}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := pr.order.Uint16(options)
+		length := int(pr.order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == 9 && length >= 1 { // if_tsresol
+			resol := options[4]
+			switch {
+			case resol&0x80 != 0:
+				iface.tsUnit, iface.tsDiv = 0, 1<<(resol&0x7f)
+			case resol <= 9:
+				iface.tsUnit = 1
+				for i := resol; i < 9; i++ {
+					iface.tsUnit *= 10
+				}
+			default:
+				iface.tsUnit, iface.tsDiv = 0, 1
+				for i := 0; i < int(resol); i++ {
+					iface.tsDiv *= 10
+				}
+			}
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return iface
+}
+
+func (iface pcapInterface) timestamp(ts uint64) time.Time {
+	if iface.tsUnit != 0 {
+		return time.Unix(0, 0).Add(time.Duration(ts) * iface.tsUnit)
+	}
+	sec := ts / iface.tsDiv
+	nsec := (ts % iface.tsDiv) * uint64(time.Second) / iface.tsDiv
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func (pr *PcapReader) decodePacket(ts time.Time, iface pcapInterface, data []byte) {
+	var ethType uint16
+	switch iface.linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return
+		}
+		ethType = binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		for ethType == 0x8100 || ethType == 0x88a8 { // vlan
+			if len(data) < 4 {
+				return
+			}
+			ethType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return
+		}
+		ethType = binary.BigEndian.Uint16(data[14:])
+		data = data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return
+		}
+		ethType = binary.BigEndian.Uint16(data)
+		data = data[20:]
+	case linkNull, linkLoop:
+		// семейство адресов в порядке байт захватившей машины, достаточно версии ip
+		if len(data) < 4 {
+			return
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	switch {
+	case ethType == 0x0800 || ethType == 0 && data[0]>>4 == 4:
+		pr.decodeIPv4(ts, data)
+	case ethType == 0x86dd || ethType == 0 && data[0]>>4 == 6:
+		pr.decodeIPv6(ts, data)
+	}
+}
+
+func (pr *PcapReader) decodeIPv4(ts time.Time, data []byte) {
+	if len(data) < 20 {
+		return
+	}
+	ihl := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:]))
+	fragment := binary.BigEndian.Uint16(data[6:])
+	if ihl < 20 || totalLen < ihl || totalLen > len(data) || fragment&0x3fff != 0 {
+		return
+	}
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+	pr.decodeTransport(ts, data[9], src, dst, data[ihl:totalLen])
+}
+
+func (pr *PcapReader) decodeIPv6(ts time.Time, data []byte) {
+	if len(data) < 40 {
+		return
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+	if 40+payloadLen > len(data) {
+		return
+	}
+	next := data[6]
+	src, _ := netip.AddrFromSlice(data[8:24])
+	dst, _ := netip.AddrFromSlice(data[24:40])
+	data = data[40 : 40+payloadLen]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 || len(data) < (int(data[1])+1)*8 {
+				return
+			}
+			next = data[0]
+			data = data[(int(data[1])+1)*8:]
+			continue
+		case ipProtoTCP, ipProtoUDP:
+			pr.decodeTransport(ts, next, src, dst, data)
+		}
+		return
+	}
+}
+
+func (pr *PcapReader) decodeTransport(ts time.Time, proto byte, srcIp, dstIp netip.Addr, data []byte) {
+	switch proto {
+	case ipProtoUDP:
+		if len(data) < 8 {
+			return
+		}
+		src := netip.AddrPortFrom(srcIp, binary.BigEndian.Uint16(data))
+		dst := netip.AddrPortFrom(dstIp, binary.BigEndian.Uint16(data[2:]))
+		if src.Port() != pr.Port && dst.Port() != pr.Port {
+			return
+		}
+		udpLen := int(binary.BigEndian.Uint16(data[4:]))
+		if udpLen < 8 || udpLen > len(data) {
+			return
+		}
+		pr.addMessage(ts, src, dst, false, data[8:udpLen])
+	case ipProtoTCP:
+		if len(data) < 20 {
+			return
+		}
+		src := netip.AddrPortFrom(srcIp, binary.BigEndian.Uint16(data))
+		dst := netip.AddrPortFrom(dstIp, binary.BigEndian.Uint16(data[2:]))
+		if src.Port() != pr.Port && dst.Port() != pr.Port {
+			return
+		}
+		offset := int(data[12]>>4) * 4
+		flags := data[13]
+		if offset < 20 || offset > len(data) {
+			return
+		}
+		flow := tcpFlow{src, dst}
+		if flags&0x02 != 0 { // SYN
+			delete(pr.streams, flow)
+		}
+		// в tcp перед каждым сообщением два байта длины
+		stream := append(pr.streams[flow], data[offset:]...)
+		for len(stream) >= 2 {
+			msgLen := int(binary.BigEndian.Uint16(stream))
+			if len(stream) < 2+msgLen {
+				break
+			}
+			pr.addMessage(ts, src, dst, true, stream[2:2+msgLen])
+			stream = stream[2+msgLen:]
+		}
+		if flags&0x05 != 0 || len(stream) == 0 { // FIN, RST
+			delete(pr.streams, flow)
+		} else {
+			pr.streams[flow] = append([]byte(nil), stream...)
+		}
+	}
+}
+
+func (pr *PcapReader) addMessage(ts time.Time, src, dst netip.AddrPort, isTCP bool, data []byte) {
+	msg := PcapMessage{Time: ts, Src: src, Dst: dst, TCP: isTCP, Data: append([]byte(nil), data...)}
+	msg.Message, msg.Err = ParseMessage(msg.Data)
+	pr.pending = append(pr.pending, msg)
+}
+
+// PcapWriter пишет dns сообщения в pcap с LINKTYPE_RAW, достраивая ip и udp/tcp заголовки.
+// можно использовать из нескольких горутин
+type PcapWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	ipId uint16
+	seq  map[tcpFlow]uint32
+}
+
+// NewPcapWriter сразу пишет заголовок файла
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagicMicro)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w, seq: map[tcpFlow]uint32{}}, nil
+}
+
+// WritePacket записывает сообщение от src к dst. тип адреса (*net.UDPAddr или *net.TCPAddr)
+// определяет транспорт
+func (pw *PcapWriter) WritePacket(t time.Time, src, dst net.Addr, msg []byte) error {
+	var isTCP bool
+	var srcAddr, dstAddr netip.AddrPort
+	switch s := src.(type) {
+	case *net.UDPAddr:
+		d, ok := dst.(*net.UDPAddr)
+		if !ok {
+			return fmt.Errorf("address type mismatch %v %v", src, dst)
+		}
+		srcAddr, dstAddr = s.AddrPort(), d.AddrPort()
+	case *net.TCPAddr:
+		d, ok := dst.(*net.TCPAddr)
+		if !ok {
+			return fmt.Errorf("address type mismatch %v %v", src, dst)
+		}
+		srcAddr, dstAddr = s.AddrPort(), d.AddrPort()
+		isTCP = true
+	default:
+		return fmt.Errorf("unsupported address type %T", src)
+	}
+	srcIp, dstIp := srcAddr.Addr().Unmap(), dstAddr.Addr().Unmap()
+	if srcIp.Is4() != dstIp.Is4() {
+		srcIp, dstIp = netip.AddrFrom16(srcIp.As16()), netip.AddrFrom16(dstIp.As16())
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var segment []byte
+	var proto byte
+	if isTCP {
+		proto = ipProtoTCP
+		segment = make([]byte, 20+2+len(msg))
+		flow := tcpFlow{srcAddr, dstAddr}
+		binary.BigEndian.PutUint16(segment, srcAddr.Port())
+		binary.BigEndian.PutUint16(segment[2:], dstAddr.Port())
+		binary.BigEndian.PutUint32(segment[4:], pw.seq[flow])
+		binary.BigEndian.PutUint32(segment[8:], pw.seq[tcpFlow{dstAddr, srcAddr}])
+		segment[12] = 5 << 4
+		segment[13] = 0x18 // PSH, ACK
+		binary.BigEndian.PutUint16(segment[14:], 65535)
+		binary.BigEndian.PutUint16(segment[20:], uint16(len(msg)))
+		copy(segment[22:], msg)
+		pw.seq[flow] += uint32(2 + len(msg))
+	} else {
+		proto = ipProtoUDP
+		segment = make([]byte, 8+len(msg))
+		binary.BigEndian.PutUint16(segment, srcAddr.Port())
+		binary.BigEndian.PutUint16(segment[2:], dstAddr.Port())
+		binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+		copy(segment[8:], msg)
+	}
+	checksumOffset := 6
+	if isTCP {
+		checksumOffset = 16
+	}
+	binary.BigEndian.PutUint16(segment[checksumOffset:], transportChecksum(srcIp, dstIp, proto, segment))
+
+	var packet []byte
+	if srcIp.Is4() {
+		packet = make([]byte, 20+len(segment))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		pw.ipId++
+		binary.BigEndian.PutUint16(packet[4:], pw.ipId)
+		binary.BigEndian.PutUint16(packet[6:], 0x4000) // DF
+		packet[8] = 64
+		packet[9] = proto
+		s, d := srcIp.As4(), dstIp.As4()
+		copy(packet[12:], s[:])
+		copy(packet[16:], d[:])
+		binary.BigEndian.PutUint16(packet[10:], ^onesSum(0, packet[:20]))
+		copy(packet[20:], segment)
+	} else {
+		packet = make([]byte, 40+len(segment))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(segment)))
+		packet[6] = proto
+		packet[7] = 64
+		s, d := srcIp.As16(), dstIp.As16()
+		copy(packet[8:], s[:])
+		copy(packet[24:], d[:])
+		copy(packet[40:], segment)
+	}
+
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record, uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	_, err := pw.w.Write(append(record, packet...))
+	return err
+}
+
+// record пишет сообщение, если запись включена. ошибки только логируются
+func (pw *PcapWriter) record(logger *slog.Logger, src, dst net.Addr, msg []byte) {
+	if pw == nil {
+		return
+	}
+	if err := pw.WritePacket(time.Now(), src, dst, msg); err != nil {
+		logger.Error("unable to write pcap", "err", err)
+	}
+}
+
+func onesSum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func transportChecksum(src, dst netip.Addr, proto byte, segment []byte) uint16 {
+	pseudo := append(src.AsSlice(), dst.AsSlice()...)
+	pseudo = append(pseudo, 0, proto, byte(len(segment)>>8), byte(len(segment)))
+	sum := onesSum(uint32(onesSum(0, pseudo)), segment)
+	if sum == 0xffff {
+		return 0xffff
+	}
+	return ^sum
+}
@@ -0,0 +1,99 @@
+package awesomedns
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPcapRoundTrip(t *testing.T) {
+	q, err := makeQuery(RR_A, "example.com", 77)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFrom := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5555}
+	udpTo := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	tcpFrom := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5555}
+	tcpTo := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53}
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		tcp      bool
+	}{
+		{"udp query", udpFrom, udpTo, false},
+		{"udp response", udpTo, udpFrom, false},
+		{"tcp query", tcpFrom, tcpTo, true},
+		{"tcp second query", tcpFrom, tcpTo, true},
+	}
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 123000)
+	for i, tt := range tests {
+		if err := pw.WritePacket(start.Add(time.Duration(i)*time.Second), tt.src, tt.dst, q); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+	}
+
+	pr, err := NewPcapReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range tests {
+		m, err := pr.Next()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if !m.Time.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("%v: time %v", tt.name, m.Time)
+		}
+		if m.Src != netip.MustParseAddrPort(tt.src.String()) || m.Dst != netip.MustParseAddrPort(tt.dst.String()) {
+			t.Errorf("%v: %v -> %v", tt.name, m.Src, m.Dst)
+		}
+		if m.TCP != tt.tcp {
+			t.Errorf("%v: tcp %v", tt.name, m.TCP)
+		}
+		if m.Err != nil || !bytes.Equal(m.Data, q) {
+			t.Errorf("%v: data %v, err %v", tt.name, m.Data, m.Err)
+		}
+		if m.Message.Header.ID != 77 || len(m.Message.Question) != 1 || m.Message.Question[0].Name != "example.com" {
+			t.Errorf("%v: message %+v", tt.name, m.Message)
+		}
+	}
+	if _, err := pr.Next(); err != io.EOF {
+		t.Errorf("after last packet: %v", err)
+	}
+}
+
+func TestPcapRecordsResolve(t *testing.T) {
+	server := udpServer(t, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.10"}}, nil)
+	})
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveA("example.com", Config{Server: server, Pcap: pw}); err != nil {
+		t.Fatal(err)
+	}
+	pr, err := NewPcapReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Port = netip.MustParseAddrPort(server).Port()
+	for _, query := range []bool{true, false} {
+		m, err := pr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Err != nil || m.Message.Header.Query != query {
+			t.Errorf("query %v: %+v", query, m)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package awesomedns
+
+// чтение настроек из resolv.conf(5)
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultResolvConf = "/etc/resolv.conf"
+
+const (
+	resolvConfMaxNameservers = 3 // MAXNS
+	resolvConfMaxNdots       = 15
+	resolvConfMaxTimeout     = 30
+	resolvConfMaxAttempts    = 5
+)
+
+// ConfigFromResolvConf строит Config из resolv.conf. пустой path - DefaultResolvConf.
+// значения по умолчанию как у glibc: сервер 127.0.0.1, ndots 1, timeout 5, attempts 2
+func ConfigFromResolvConf(path string) (Config, error) {
+	if path == "" {
+		path = DefaultResolvConf
+	}
+	config := Config{
+		Ndots:      1,
+		Attempts:   2,
+		UDPTimeout: 5 * time.Second,
+		TCPTimeout: 5 * time.Second,
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || len(servers) >= resolvConfMaxNameservers {
+				continue
+			}
+			// адрес может быть с зоной, например fe80::1%eth0. неверный адрес
+			// пропускается, как в glibc
+			host, _, _ := strings.Cut(fields[1], "%")
+			if net.ParseIP(host) == nil {
+				continue
+			}
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		case "domain":
+			if len(fields) > 1 {
+				config.Search = []string{strings.TrimSuffix(fields[1], ".")}
+			}
+		case "search":
+			config.Search = nil
+			for _, domain := range fields[1:] {
+				config.Search = append(config.Search, strings.TrimSuffix(domain, "."))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				parseResolvConfOption(option, &config)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return config, err
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	config.Server = servers[0]
+	config.Servers = servers[1:]
+	return config, nil
+}
+
+// parseResolvConfOption неизвестные и некорректные опции пропускаются, как в glibc
+func parseResolvConfOption(option string, config *Config) {
+	name, value, _ := strings.Cut(option, ":")
+	n, err := strconv.Atoi(value)
+	switch name {
+	case "ndots":
+		if err == nil && n >= 0 {
+			config.Ndots = min(n, resolvConfMaxNdots)
+		}
+	case "timeout":
+		if err == nil && n >= 1 {
+			config.UDPTimeout = time.Duration(min(n, resolvConfMaxTimeout)) * time.Second
+			config.TCPTimeout = config.UDPTimeout
+		}
+	case "attempts":
+		if err == nil && n >= 1 {
+			config.Attempts = min(n, resolvConfMaxAttempts)
+		}
+	case "rotate":
+		config.Rotate = true
+	case "edns0":
+		config.Edns0 = true
+	case "use-vc":
+		config.IsTCP = true
+	}
+}
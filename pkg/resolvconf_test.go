@@ -0,0 +1,75 @@
+package awesomedns
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFromResolvConf(t *testing.T) {
+	tests := []struct {
+		file string
+		want Config
+	}{
+		{"resolv-full.conf", Config{
+			Server:     "192.0.2.1:53",
+			Servers:    []string{"[fe80::1%eth0]:53", "[2001:db8::53]:53"},
+			Search:     []string{"a.example", "b.example"},
+			Ndots:      3,
+			Attempts:   resolvConfMaxAttempts,
+			UDPTimeout: 2 * time.Second,
+			TCPTimeout: 2 * time.Second,
+			Rotate:     true,
+			Edns0:      true,
+			IsTCP:      true,
+		}},
+		{"resolv-empty.conf", Config{
+			Server:     "127.0.0.1:53",
+			Ndots:      1,
+			Attempts:   2,
+			UDPTimeout: 5 * time.Second,
+			TCPTimeout: 5 * time.Second,
+		}},
+		// последняя из domain и search побеждает, значения вне пределов обрезаются
+		{"resolv-domain.conf", Config{
+			Server:     "192.0.2.1:53",
+			Search:     []string{"last.example"},
+			Ndots:      resolvConfMaxNdots,
+			Attempts:   2,
+			UDPTimeout: resolvConfMaxTimeout * time.Second,
+			TCPTimeout: resolvConfMaxTimeout * time.Second,
+		}},
+		// неверный адрес пропускается, разбор продолжается
+		{"resolv-badns.conf", Config{
+			Server:     "192.0.2.1:53",
+			Servers:    []string{"192.0.2.2:53"},
+			Ndots:      2,
+			Attempts:   2,
+			UDPTimeout: 5 * time.Second,
+			TCPTimeout: 5 * time.Second,
+		}},
+	}
+	for _, tt := range tests {
+		config, err := ConfigFromResolvConf(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Errorf("%v: %v", tt.file, err)
+			continue
+		}
+		if len(config.Servers) == 0 {
+			config.Servers = nil
+		}
+		if !reflect.DeepEqual(config, tt.want) {
+			t.Errorf("%v:\n got %+v\nwant %+v", tt.file, config, tt.want)
+		}
+	}
+}
+
+func TestConfigFromResolvConfMissing(t *testing.T) {
+	_, err := ConfigFromResolvConf(filepath.Join("testdata", "missing.conf"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
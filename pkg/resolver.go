@@ -0,0 +1,268 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTimeout = 15 * time.Second
+
+// Resolver выполняет запросы с учетом контекста: отмена и дедлайн контекста
+// действуют на соединение, запись и чтение
+type Resolver struct {
+	config   Config
+	rotation atomic.Uint32
+}
+
+func NewResolver(config Config) *Resolver {
+	r := &Resolver{config: config}
+	r.config.rotation = &r.rotation
+	return r
+}
+
+type timeoutsCtxKey struct{}
+
+type callTimeouts struct {
+	udp, tcp time.Duration
+}
+
+// WithTimeouts контекст вызова со своими таймаутами обмена по udp и tcp.
+// 0 оставляет таймаут из Config
+func WithTimeouts(ctx context.Context, udp, tcp time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutsCtxKey{}, callTimeouts{udp, tcp})
+}
+
+// exchangeContext контекст обмена с сервером. таймаут берется из WithTimeouts,
+// затем из Config. если не задан ни один, действует дедлайн ctx, а без него defaultTimeout
+func (config Config) exchangeContext(ctx context.Context, isTCP bool) (context.Context, context.CancelFunc) {
+	timeout := config.UDPTimeout
+	if isTCP {
+		timeout = config.TCPTimeout
+	}
+	if call, ok := ctx.Value(timeoutsCtxKey{}).(callTimeouts); ok {
+		if isTCP && call.tcp > 0 {
+			timeout = call.tcp
+		}
+		if !isTCP && call.udp > 0 {
+			timeout = call.udp
+		}
+	}
+	if timeout <= 0 {
+		if _, ok := ctx.Deadline(); ok {
+			return context.WithCancel(ctx)
+		}
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (r *Resolver) ResolveA(ctx context.Context, qname string) ([]net.IP, error) {
+	_, ips, err := r.ResolveACanonical(ctx, qname)
+	return ips, err
+}
+
+// ResolveACanonical адреса вместе с каноническим именем, которому они принадлежат.
+// для записей из hosts каноническое имя - qname
+func (r *Resolver) ResolveACanonical(ctx context.Context, qname string) (string, []net.IP, error) {
+	canonical := qname
+	ips, err := withHosts(r.config, func() []net.IP {
+		ips := hostsIPs(r.config.Hosts, qname, true)
+		if len(ips) > 0 {
+			canonical = qname
+		}
+		return ips
+	}, func() ([]net.IP, error) {
+		var ret []net.IP
+		res, err := r.Lookup(ctx, RR_A, qname)
+		if err != nil {
+			return nil, err
+		}
+		canonical = res.Canonical
+		for _, v := range res.Records {
+			switch v.(type) {
+			case net.IP:
+				ret = append(ret, v.(net.IP))
+			default:
+				return nil, errors.New("unknown")
+			}
+		}
+		return ret, nil
+	})
+	return canonical, ips, err
+}
+
+func (r *Resolver) ResolveAaaa(ctx context.Context, qname string) ([]net.IP, error) {
+	return withHosts(r.config, func() []net.IP {
+		return hostsIPs(r.config.Hosts, qname, false)
+	}, func() ([]net.IP, error) {
+		return r.resolveAaaa(ctx, qname)
+	})
+}
+
+func (r *Resolver) resolveAaaa(ctx context.Context, qname string) ([]net.IP, error) {
+	var ret []net.IP
+	res, _, err := r.Resolve(ctx, RR_AAAA, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case net.IP:
+			ret = append(ret, v.(net.IP))
+		default:
+			return nil, errors.New("unknown")
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveCname(ctx context.Context, qname string) ([]string, error) {
+	var ret []string
+	res, _, err := r.Resolve(ctx, RR_CNAME, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case string:
+			ret = append(ret, v.(string))
+		default:
+			return nil, fmt.Errorf("unknown type - %v", v)
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveNs(ctx context.Context, qname string) ([]string, error) {
+	var ret []string
+	res, _, err := r.Resolve(ctx, RR_NS, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case string:
+			ret = append(ret, v.(string))
+		default:
+			return nil, fmt.Errorf("unknown type - %v", v)
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveSoa(ctx context.Context, qname string) ([]DnsSoa, error) {
+	var ret []DnsSoa
+	res, _, err := r.Resolve(ctx, RR_SOA, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case DnsSoa:
+			ret = append(ret, v.(DnsSoa))
+		default:
+			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
+		}
+	}
+	return ret, nil
+}
+
+// ResolvePtr имена для адреса в текстовом виде ("192.0.2.1", "2001:db8::1") или
+// для имени в in-addr.arpa/ip6.arpa. другие имена спрашиваются как есть
+func (r *Resolver) ResolvePtr(ctx context.Context, qname string) ([]string, error) {
+	if addr, err := netip.ParseAddr(qname); err == nil {
+		return r.ResolvePtrAddr(ctx, addr)
+	}
+	if addr, err := AddrFromReverseName(qname); err == nil {
+		return r.ResolvePtrAddr(ctx, addr)
+	}
+	return r.resolvePtr(ctx, qname)
+}
+
+func (r *Resolver) ResolvePtrIP(ctx context.Context, ip net.IP) ([]string, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, fmt.Errorf("wrong ip address %v", ip)
+	}
+	return r.ResolvePtrAddr(ctx, addr)
+}
+
+// ResolvePtrAddr имена для адреса из hosts и PTR записи ReverseName(addr)
+func (r *Resolver) ResolvePtrAddr(ctx context.Context, addr netip.Addr) ([]string, error) {
+	addr = addr.Unmap().WithZone("")
+	return withHosts(r.config, func() []string {
+		return r.config.Hosts.LookupAddr(addr.AsSlice())
+	}, func() ([]string, error) {
+		return r.resolvePtr(ctx, ReverseName(addr)+".")
+	})
+}
+
+func (r *Resolver) resolvePtr(ctx context.Context, qname string) ([]string, error) {
+	var ret []string
+	res, _, err := r.Resolve(ctx, RR_PTR, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case string:
+			ret = append(ret, v.(string))
+		default:
+			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveMx(ctx context.Context, qname string) ([]DnsMx, error) {
+	var ret []DnsMx
+	res, _, err := r.Resolve(ctx, RR_MX, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case DnsMx:
+			ret = append(ret, v.(DnsMx))
+		default:
+			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveSrv(ctx context.Context, qname string) ([]DnsSRV, error) {
+	var ret []DnsSRV
+	res, _, err := r.Resolve(ctx, RR_SRV, qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res {
+		switch v.(type) {
+		case DnsSRV:
+			ret = append(ret, v.(DnsSRV))
+		default:
+			return nil, fmt.Errorf("unknown type - %v with value %v", reflect.TypeOf(v), v)
+		}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) ResolveAny(ctx context.Context, qname string) ([]interface{}, error) {
+	res, _, err := r.Resolve(ctx, RR_ANY, qname)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *Resolver) Resolve(ctx context.Context, rrtype DnsType, qname string) ([]interface{}, int, error) {
+	res, err := r.Lookup(ctx, rrtype, qname)
+	return res.Records, res.ID, err
+}
@@ -0,0 +1,118 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// silentServers udp и tcp заглушки, которые принимают запрос и не отвечают
+func silentServers(t *testing.T) (udp, tcp string) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	udp = udpServer(t, func(q []byte) []byte { return nil })
+	tcp = tcpServer(t, func(q []byte) []byte {
+		<-done
+		return nil
+	})
+	return udp, tcp
+}
+
+func TestExchangeContext(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		config   Config
+		deadline time.Duration // дедлайн ctx, 0 - без дедлайна
+		call     *callTimeouts
+		isTCP    bool
+		want     time.Duration
+	}{
+		{"default", Config{}, 0, nil, false, defaultTimeout},
+		{"config udp", Config{UDPTimeout: time.Second, TCPTimeout: time.Minute}, 0, nil, false, time.Second},
+		{"config tcp", Config{UDPTimeout: time.Second, TCPTimeout: time.Minute}, 0, nil, true, time.Minute},
+		{"ctx deadline instead of default", Config{}, time.Hour, nil, false, time.Hour},
+		{"ctx deadline before config", Config{UDPTimeout: time.Minute}, time.Second, nil, false, time.Second},
+		{"config before ctx deadline", Config{UDPTimeout: time.Second}, time.Minute, nil, false, time.Second},
+		{"call udp", Config{UDPTimeout: time.Minute}, 0, &callTimeouts{udp: time.Second}, false, time.Second},
+		{"call tcp", Config{TCPTimeout: time.Minute}, 0, &callTimeouts{tcp: time.Second}, true, time.Second},
+		{"call keeps other protocol", Config{TCPTimeout: time.Minute}, 0, &callTimeouts{udp: time.Second}, true, time.Minute},
+		{"call capped by ctx deadline", Config{}, time.Second, &callTimeouts{udp: time.Minute}, false, time.Second},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, now.Add(tt.deadline))
+			defer cancel()
+		}
+		if tt.call != nil {
+			ctx = WithTimeouts(ctx, tt.call.udp, tt.call.tcp)
+		}
+		ctx, cancel := tt.config.exchangeContext(ctx, tt.isTCP)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if got := deadline.Sub(now); !ok || got < tt.want || got > tt.want+time.Second {
+			t.Errorf("%v: deadline in %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	udp, tcp := silentServers(t)
+	tests := []struct {
+		name   string
+		config Config
+		ctx    func() (context.Context, context.CancelFunc)
+	}{
+		{"udp config", Config{Server: udp, UDPTimeout: 50 * time.Millisecond, TCPTimeout: time.Minute}, func() (context.Context, context.CancelFunc) {
+			return context.Background(), func() {}
+		}},
+		{"tcp config", Config{Server: tcp, IsTCP: true, UDPTimeout: time.Minute, TCPTimeout: 50 * time.Millisecond}, func() (context.Context, context.CancelFunc) {
+			return context.Background(), func() {}
+		}},
+		{"udp ctx deadline", Config{Server: udp, UDPTimeout: time.Minute}, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+		{"tcp ctx deadline", Config{Server: tcp, IsTCP: true}, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+		{"udp per call", Config{Server: udp, UDPTimeout: time.Minute}, func() (context.Context, context.CancelFunc) {
+			return WithTimeouts(context.Background(), 50*time.Millisecond, 0), func() {}
+		}},
+		{"tcp per call", Config{Server: tcp, IsTCP: true, TCPTimeout: time.Minute}, func() (context.Context, context.CancelFunc) {
+			return WithTimeouts(context.Background(), time.Minute, 50*time.Millisecond), func() {}
+		}},
+	}
+	for _, tt := range tests {
+		ctx, cancel := tt.ctx()
+		start := time.Now()
+		_, err := NewResolver(tt.config).ResolveA(ctx, "example.com")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%v: took %v", tt.name, elapsed)
+		}
+	}
+}
+
+// отмена во время ожидания ответа прерывает чтение
+func TestResolverCancel(t *testing.T) {
+	udp, tcp := silentServers(t)
+	for _, config := range []Config{{Server: udp}, {Server: tcp, IsTCP: true}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := NewResolver(config).ResolveA(ctx, "example.com")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("tcp %v: err = %v", config.IsTCP, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("tcp %v: took %v", config.IsTCP, elapsed)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package awesomedns
+
+// имена для обратных запросов: in-addr.arpa (rfc1035 3.5) и ip6.arpa (rfc3596 2.5)
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var errNotReverseName = errors.New("not a reverse name")
+
+// ReverseName имя для PTR запроса без точки в конце: 4.3.2.1.in-addr.arpa
+// или 32 полубайта в ip6.arpa. ipv4 внутри ipv6 (::ffff:1.2.3.4) считается ipv4
+func ReverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	var b strings.Builder
+	if addr.Is4() {
+		octets := addr.As4()
+		for i := len(octets) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(octets[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa")
+		return b.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	octets := addr.As16()
+	for i := len(octets) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[octets[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[octets[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+// AddrFromReverseName адрес из полного обратного имени, обратная к ReverseName.
+// регистр и точка в конце не важны, имена сетей (3.2.1.in-addr.arpa) не принимаются
+func AddrFromReverseName(name string) (netip.Addr, error) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		var octets [4]byte
+		for i := 0; i < 4; i++ {
+			n, err := strconv.Atoi(labels[3-i])
+			// без ведущих нулей, иначе у адреса было бы несколько имен
+			if err != nil || n < 0 || n > 255 || strconv.Itoa(n) != labels[3-i] {
+				return netip.Addr{}, errNotReverseName
+			}
+			octets[i] = byte(n)
+		}
+		return netip.AddrFrom4(octets), nil
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		var octets [16]byte
+		for i := 0; i < 32; i++ {
+			nibble, ok := hexNibble(labels[i])
+			if !ok {
+				return netip.Addr{}, errNotReverseName
+			}
+			// первая метка - младший полубайт последнего байта
+			if i%2 == 0 {
+				octets[15-i/2] |= nibble
+			} else {
+				octets[15-i/2] |= nibble << 4
+			}
+		}
+		return netip.AddrFrom16(octets), nil
+	}
+	return netip.Addr{}, errNotReverseName
+}
+
+func hexNibble(label string) (byte, bool) {
+	if len(label) != 1 {
+		return 0, false
+	}
+	c := label[0]
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	}
+	return 0, false
+}
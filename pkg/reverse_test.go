@@ -0,0 +1,87 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		name string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"10.0.0.255", "255.0.0.10.in-addr.arpa"},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{"::", "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		if got := ReverseName(addr); got != tt.name {
+			t.Errorf("ReverseName(%v) = %v, want %v", tt.addr, got, tt.name)
+		}
+		back, err := AddrFromReverseName(tt.name + ".")
+		if err != nil || back != addr.Unmap() {
+			t.Errorf("AddrFromReverseName(%v) = %v, %v", tt.name, back, err)
+		}
+	}
+}
+
+func TestAddrFromReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string // пусто - не обратное имя
+	}{
+		{"1.2.0.192.IN-ADDR.ARPA", "192.0.2.1"},
+		{"B.A.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.ip6.arpa.", "2001:db8::567:89ab"},
+		{"2.0.192.in-addr.arpa", ""},
+		{"01.2.0.192.in-addr.arpa", ""},
+		{"256.2.0.192.in-addr.arpa", ""},
+		{"-1.2.0.192.in-addr.arpa", ""},
+		{"1.2.0.192.in-addr.arpa.example", ""},
+		{"0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"g.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"ba.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.x", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		addr, err := AddrFromReverseName(tt.name)
+		if tt.addr == "" {
+			if !errors.Is(err, errNotReverseName) {
+				t.Errorf("AddrFromReverseName(%v) = %v, %v", tt.name, addr, err)
+			}
+			continue
+		}
+		if err != nil || addr != netip.MustParseAddr(tt.addr) {
+			t.Errorf("AddrFromReverseName(%v) = %v, %v, want %v", tt.name, addr, err, tt.addr)
+		}
+	}
+}
+
+func TestResolvePtr(t *testing.T) {
+	transport, queries := fakeTransport(t, 0, testRR{"", RR_PTR, 60, "host.example"})
+	config := Config{Transport: transport}
+	resolver := NewResolver(config)
+	for _, qname := range []string{"192.0.2.1", "::ffff:192.0.2.1", "1.2.0.192.IN-ADDR.ARPA"} {
+		if res, err := ResolvePtr(qname, config); err != nil || !reflect.DeepEqual(res, []string{"host.example"}) {
+			t.Errorf("ResolvePtr(%v) = %v, %v", qname, res, err)
+		}
+	}
+	if _, err := resolver.ResolvePtrIP(context.Background(), net.ParseIP("2001:db8::567:89ab")); err != nil {
+		t.Error(err)
+	}
+	want := []string{
+		"1.2.0.192.in-addr.arpa",
+		"1.2.0.192.in-addr.arpa",
+		"1.2.0.192.in-addr.arpa",
+		"b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	if q := queries(); !reflect.DeepEqual(q, want) {
+		t.Errorf("queries %v, want %v", q, want)
+	}
+}
@@ -0,0 +1,71 @@
+package awesomedns
+
+// дополнение коротких имен доменами из search по правилам resolv.conf:
+// имя с точкой в конце спрашивается как есть, имя с не меньше чем ndots точками
+// сначала как есть, затем с доменами, остальные - наоборот
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// LookupResult ответ вместе с подробностями поиска
+type LookupResult struct {
+	Name      string   // имя, на которое получен ответ
+	Tried     []string // опрошенные имена по порядку
+	Canonical string   // имя после CNAME и DNAME, которому принадлежат Records
+	Records   []interface{}
+	ID        int
+}
+
+// Lookup перебирает имена из search и возвращает первый ответ, отличный от NXDOMAIN.
+// Tried заполняется и при ошибке
+func (r *Resolver) Lookup(ctx context.Context, rrtype DnsType, qname string) (LookupResult, error) {
+	var res LookupResult
+	var records []DnsRecord
+	var err error
+	for _, name := range r.config.searchNames(qname) {
+		res.Tried = append(res.Tried, name)
+		res.Canonical, records, res.ID, err = resolveChain(ctx, rrtype, name, r.config)
+		res.Records = recordsData(records)
+		if !errors.Is(err, errNameError) {
+			res.Name = name
+			return res, err
+		}
+	}
+	return res, err
+}
+
+// searchNames имена для перебора в порядке опроса
+func (config Config) searchNames(qname string) []string {
+	if isFQDN(qname) {
+		return []string{strings.TrimSuffix(qname, ".")}
+	}
+	if len(config.Search) == 0 {
+		return []string{qname}
+	}
+	var res []string
+	dots := strings.Count(qname, ".") - strings.Count(qname, `\.`)
+	if dots >= config.Ndots {
+		res = append(res, qname)
+	}
+	for _, domain := range config.Search {
+		res = append(res, qname+"."+domain)
+	}
+	if dots < config.Ndots {
+		res = append(res, qname)
+	}
+	return res
+}
+
+// isFQDN true если имя заканчивается неэкранированной точкой
+func isFQDN(name string) bool {
+	if !strings.HasSuffix(name, ".") {
+		return false
+	}
+	backslashes := 0
+	for i := len(name) - 2; i >= 0 && name[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
@@ -0,0 +1,81 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSearchNames(t *testing.T) {
+	search := []string{"a.example", "b.example"}
+	tests := []struct {
+		qname  string
+		search []string
+		ndots  int
+		want   []string
+	}{
+		{"db", search, 1, []string{"db.a.example", "db.b.example", "db"}},
+		{"db.corp", search, 1, []string{"db.corp", "db.corp.a.example", "db.corp.b.example"}},
+		{"db.corp", search, 2, []string{"db.corp.a.example", "db.corp.b.example", "db.corp"}},
+		{"db", search, 0, []string{"db", "db.a.example", "db.b.example"}},
+		// точка в конце отключает search
+		{"db.", search, 1, []string{"db"}},
+		{"db.corp.", search, 5, []string{"db.corp"}},
+		// экранированная точка не считается ни концом имени, ни разделителем
+		{`db\.`, search, 1, []string{`db\..a.example`, `db\..b.example`, `db\.`}},
+		{`db\\.`, search, 1, []string{`db\\`}},
+		{"db", nil, 1, []string{"db"}},
+	}
+	for _, tt := range tests {
+		config := Config{Search: tt.search, Ndots: tt.ndots}
+		if got := config.searchNames(tt.qname); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchNames(%q) ndots %v = %q, want %q", tt.qname, tt.ndots, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	// имена с ответом, с SERVFAIL, остальные получают NXDOMAIN
+	server := udpServer(t, func(q []byte) []byte {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil
+		}
+		switch name := msg.Question[0].Name; name {
+		case "db.b.example", "www.example.com":
+			return testResponse(t, q, 0, []testRR{{name, RR_A, 60, "192.0.2.1"}}, nil)
+		case "broken.a.example":
+			return testResponse(t, q, 2, nil, nil)
+		}
+		return testResponse(t, q, 3, nil, nil)
+	})
+	config := Config{Server: server, Search: []string{"a.example", "b.example"}, Ndots: 1}
+	tests := []struct {
+		qname string
+		name  string
+		tried []string
+		err   error
+	}{
+		{"db", "db.b.example", []string{"db.a.example", "db.b.example"}, nil},
+		{"www.example.com", "www.example.com", []string{"www.example.com"}, nil},
+		{"missing", "", []string{"missing.a.example", "missing.b.example", "missing"}, errNameError},
+		// ответ кроме NXDOMAIN останавливает перебор
+		{"broken", "broken.a.example", []string{"broken.a.example"}, errServFail},
+		{"db.b.example.", "db.b.example", []string{"db.b.example"}, nil},
+		{"db.", "", []string{"db"}, errNameError},
+	}
+	r := NewResolver(config)
+	for _, tt := range tests {
+		res, err := r.Lookup(context.Background(), RR_A, tt.qname)
+		if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%v: err = %v, want %v", tt.qname, err, tt.err)
+		}
+		if res.Name != tt.name || !reflect.DeepEqual(res.Tried, tt.tried) {
+			t.Errorf("%v: name %q, tried %q, want %q, %q", tt.qname, res.Name, res.Tried, tt.name, tt.tried)
+		}
+		if tt.err == nil && len(res.Records) != 1 {
+			t.Errorf("%v: records %v", tt.qname, res.Records)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package awesomedns
+
+// постоянные tcp соединения по rfc7766: на одно соединение к серверу отправляется несколько
+// запросов без ожидания ответов, ответы сопоставляются по id в любом порядке.
+// соединение закрывается после простоя, срок которого сервер может задать через
+// edns-tcp-keepalive (rfc7828)
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultIdleTimeout = 10 * time.Second
+
+var (
+	errPoolClosed  = errors.New("connection pool is closed")
+	errIdleTimeout = errors.New("idle timeout")
+)
+
+type dialFunc = func(ctx context.Context, server string) (net.Conn, error)
+
+type TCPPool struct {
+	// простой, после которого соединение закрывается, если сервер не объявил другой
+	IdleTimeout time.Duration
+	// Dial открывает соединение к серверу, по умолчанию tcp с LocalAddr и BindDevice
+	// из Config запроса
+	Dial dialFunc
+
+	mu      sync.Mutex
+	conns   map[string]*pipeConn
+	dialing map[string]chan struct{} // закрывается, когда соединение открыто или не открылось
+	closed  bool
+}
+
+type pipeConn struct {
+	pool   *TCPPool
+	server string
+	conn   net.Conn
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	idle    time.Duration
+	timer   *time.Timer
+	err     error // причина закрытия
+}
+
+func NewTCPPool() *TCPPool {
+	return &TCPPool{IdleTimeout: defaultIdleTimeout, conns: map[string]*pipeConn{}}
+}
+
+// Exchange отправляет запрос и ждет ответ на него. id запроса может быть занят
+// другим запросом в том же соединении, тогда он временно подменяется
+func (p *TCPPool) Exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	res, _, _, err := p.exchange(ctx, server, query, Config{}.dialTCP)
+	return res, err
+}
+
+// exchanger обмен через пул для exchangeRecorded, новые соединения открываются через dial
+func (p *TCPPool) exchanger(dial dialFunc) func(context.Context, string, []byte) ([]byte, net.Addr, net.Addr, error) {
+	return func(ctx context.Context, server string, query []byte) ([]byte, net.Addr, net.Addr, error) {
+		return p.exchange(ctx, server, query, dial)
+	}
+}
+
+func (p *TCPPool) exchange(ctx context.Context, server string, query []byte, dial dialFunc) ([]byte, net.Addr, net.Addr, error) {
+	if len(query) < headerLen {
+		return nil, nil, nil, errFormat
+	}
+	keepalive := EdnsOption{Code: EdnsTCPKeepalive}
+	if res, ok := addOption(query, keepalive); ok {
+		query = res
+	} else if !hasAdditional(query) {
+		query = appendOpt(query, defaultEdnsUDPSize, keepalive)
+	} else {
+		query = append([]byte(nil), query...)
+	}
+	originalId := binary.BigEndian.Uint16(query)
+	for {
+		c, err := p.get(ctx, server, dial)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		id, ch, ok := c.register(originalId)
+		if !ok {
+			// соединение закрылось между get и register
+			continue
+		}
+		binary.BigEndian.PutUint16(query, id)
+		if err = c.write(ctx, query); err != nil {
+			c.unregister(id)
+			c.close(err)
+			return nil, nil, nil, err
+		}
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				return nil, nil, nil, c.closeErr()
+			}
+			binary.BigEndian.PutUint16(res, originalId)
+			return res, c.conn.LocalAddr(), c.conn.RemoteAddr(), nil
+		case <-ctx.Done():
+			c.unregister(id)
+			return nil, nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Close закрывает все соединения, ожидающие запросы получают ошибку
+func (p *TCPPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = map[string]*pipeConn{}
+	p.mu.Unlock()
+	for _, c := range conns {
+		c.close(errPoolClosed)
+	}
+	return nil
+}
+
+// get соединение к серверу из пула или новое. соединение открывается без блокировки пула,
+// чтобы медленный сервер не задерживал запросы к остальным. одновременные запросы
+// к тому же серверу ждут, пока откроется одно соединение
+func (p *TCPPool) get(ctx context.Context, server string, dial dialFunc) (*pipeConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		if c, ok := p.conns[server]; ok {
+			p.mu.Unlock()
+			return c, nil
+		}
+		if wait, ok := p.dialing[server]; ok {
+			p.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if p.dialing == nil {
+			p.dialing = map[string]chan struct{}{}
+		}
+		done := make(chan struct{})
+		p.dialing[server] = done
+		p.mu.Unlock()
+
+		if p.Dial != nil {
+			dial = p.Dial
+		}
+		conn, err := dial(ctx, server)
+
+		p.mu.Lock()
+		delete(p.dialing, server)
+		close(done)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return nil, errPoolClosed
+		}
+		if p.conns == nil {
+			p.conns = map[string]*pipeConn{}
+		}
+		idle := p.IdleTimeout
+		if idle <= 0 {
+			idle = defaultIdleTimeout
+		}
+		c := &pipeConn{pool: p, server: server, conn: conn, pending: map[uint16]chan []byte{}, idle: idle}
+		c.timer = time.AfterFunc(idle, c.closeIfIdle)
+		p.conns[server] = c
+		p.mu.Unlock()
+		go c.readLoop()
+		return c, nil
+	}
+}
+
+func (c *pipeConn) register(id uint16) (uint16, chan []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, false
+	}
+	// id уже проверен на случайность при создании запроса, а подделать ответ
+	// внутри tcp соединения нельзя, поэтому свободный id ищется подряд
+	for c.pending[id] != nil {
+		id++
+	}
+	ch := make(chan []byte, 1)
+	c.pending[id] = ch
+	c.timer.Stop()
+	return id, ch, true
+}
+
+func (c *pipeConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	if len(c.pending) == 0 && c.err == nil {
+		c.timer.Reset(c.idle)
+	}
+}
+
+func (c *pipeConn) write(ctx context.Context, query []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	_, err := c.conn.Write(append(frame, query...))
+	return err
+}
+
+func (c *pipeConn) readLoop() {
+	size := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, size); err != nil {
+			c.close(err)
+			return
+		}
+		res := make([]byte, binary.BigEndian.Uint16(size))
+		if _, err := io.ReadFull(c.conn, res); err != nil {
+			c.close(err)
+			return
+		}
+		if len(res) < headerLen {
+			continue
+		}
+		if keepalive, ok := tcpKeepalive(res); ok {
+			c.mu.Lock()
+			c.idle = keepalive
+			c.mu.Unlock()
+		}
+		id := binary.BigEndian.Uint16(res)
+		c.mu.Lock()
+		if ch, ok := c.pending[id]; ok {
+			ch <- res
+			delete(c.pending, id)
+			if len(c.pending) == 0 {
+				c.timer.Reset(c.idle)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// closeIfIdle закрывает соединение, если на нем нет запросов. проверка и отметка о закрытии
+// делаются под одной блокировкой, иначе запрос, зарегистрированный между ними, получит отказ
+func (c *pipeConn) closeIfIdle() {
+	if c.markClosed(errIdleTimeout, true) {
+		c.shutdown()
+	}
+}
+
+func (c *pipeConn) close(reason error) {
+	if c.markClosed(reason, false) {
+		c.shutdown()
+	}
+}
+
+// markClosed запоминает причину закрытия и убирает соединение из пула. false, если
+// соединение уже закрыто или, при onlyIdle, на нем есть запросы
+func (c *pipeConn) markClosed(reason error, onlyIdle bool) bool {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || onlyIdle && len(c.pending) > 0 {
+		return false
+	}
+	c.err = reason
+	if c.pool.conns[c.server] == c {
+		delete(c.pool.conns, c.server)
+	}
+	return true
+}
+
+// shutdown закрывает соединение, ожидающие запросы получают c.err
+func (c *pipeConn) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer.Stop()
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *pipeConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
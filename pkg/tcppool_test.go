@@ -0,0 +1,271 @@
+package awesomedns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeServer tcp заглушка, которая читает из соединения batch запросов и только потом
+// отвечает на них в обратном порядке. полученные запросы попадают в queries,
+// закрытие соединения клиентом - в closed
+type pipeServer struct {
+	addr    string
+	conns   atomic.Int32
+	queries chan []byte
+	closed  chan struct{}
+}
+
+func newPipeServer(t *testing.T, batch int, handler func(q []byte) []byte) *pipeServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &pipeServer{addr: l.Addr().String(), queries: make(chan []byte, 100), closed: make(chan struct{}, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn, batch, handler)
+		}
+	}()
+	return s
+}
+
+func (s *pipeServer) serve(conn net.Conn, batch int, handler func(q []byte) []byte) {
+	defer conn.Close()
+	size := make([]byte, 2)
+	for {
+		var got [][]byte
+		for len(got) < batch {
+			if _, err := io.ReadFull(conn, size); err != nil {
+				s.closed <- struct{}{}
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(size))
+			if _, err := io.ReadFull(conn, q); err != nil {
+				return
+			}
+			s.queries <- q
+			got = append(got, q)
+		}
+		for i := len(got) - 1; i >= 0; i-- {
+			res := handler(got[i])
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(res))), res...))
+		}
+	}
+}
+
+// answerByName ответ с адресом, который зависит от имени в запросе
+func answerByName(t *testing.T) func(q []byte) []byte {
+	return func(q []byte) []byte {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		name := msg.Question[0].Name
+		return testResponse(t, q, 0, []testRR{{name, RR_A, 60, poolTestAddrs[name]}}, nil)
+	}
+}
+
+var poolTestAddrs = map[string]string{"a.example": "192.0.2.1", "b.example": "192.0.2.2", "c.example": "192.0.2.3"}
+
+// poolExchange запрос к пулу с проверкой, что ответ пришел на этот запрос
+func poolExchange(t *testing.T, pool *TCPPool, server, name string, id int) {
+	q, err := makeQuery(RR_A, name, id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := pool.Exchange(ctx, server, q)
+	if err != nil {
+		t.Errorf("%v: %v", name, err)
+		return
+	}
+	if err = verifyResponse(q, res, true); err != nil {
+		t.Errorf("%v: %v", name, err)
+		return
+	}
+	ips, _, err := parseDnsAnswer(res, false)
+	if err != nil || len(ips) != 1 || !ips[0].(net.IP).Equal(net.ParseIP(poolTestAddrs[name])) {
+		t.Errorf("%v: %v, %v", name, ips, err)
+	}
+}
+
+// три запроса уходят по одному соединению до первого ответа, ответы в обратном порядке
+func TestPoolPipelining(t *testing.T) {
+	server := newPipeServer(t, 3, answerByName(t))
+	pool := NewTCPPool()
+	defer pool.Close()
+	var wg sync.WaitGroup
+	for i, name := range []string{"a.example", "b.example", "c.example"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poolExchange(t, pool, server.addr, name, 100+i)
+		}()
+	}
+	wg.Wait()
+	if n := server.conns.Load(); n != 1 {
+		t.Errorf("%v connections", n)
+	}
+}
+
+// одинаковые id в одном соединении подменяются, клиент получает ответ со своим id
+func TestPoolIdCollision(t *testing.T) {
+	server := newPipeServer(t, 2, answerByName(t))
+	pool := NewTCPPool()
+	defer pool.Close()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example", "b.example"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poolExchange(t, pool, server.addr, name, 7)
+		}()
+	}
+	wg.Wait()
+	first, second := <-server.queries, <-server.queries
+	if binary.BigEndian.Uint16(first) == binary.BigEndian.Uint16(second) {
+		t.Errorf("both queries sent with id %v", binary.BigEndian.Uint16(first))
+	}
+}
+
+func TestPoolIdleClose(t *testing.T) {
+	keepalive := func(t *testing.T, q []byte, value uint16) []byte {
+		res := answerByName(t)(q)
+		return appendOpt(res, defaultEdnsUDPSize, EdnsOption{EdnsTCPKeepalive, binary.BigEndian.AppendUint16(nil, value)})
+	}
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		handler func(t *testing.T, q []byte) []byte
+	}{
+		{"pool idle timeout", 50 * time.Millisecond, func(t *testing.T, q []byte) []byte { return answerByName(t)(q) }},
+		// сервер просит закрыть через 100 мс вместо минуты
+		{"keepalive from server", time.Minute, func(t *testing.T, q []byte) []byte { return keepalive(t, q, 1) }},
+	}
+	for _, tt := range tests {
+		server := newPipeServer(t, 1, func(q []byte) []byte { return tt.handler(t, q) })
+		pool := NewTCPPool()
+		pool.IdleTimeout = tt.idle
+		poolExchange(t, pool, server.addr, "a.example", 1)
+		select {
+		case <-server.closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v: connection not closed", tt.name)
+		}
+		pool.mu.Lock()
+		n := len(pool.conns)
+		pool.mu.Unlock()
+		if n != 0 {
+			t.Errorf("%v: %v connections in pool", tt.name, n)
+		}
+		// следующий запрос открывает новое соединение
+		poolExchange(t, pool, server.addr, "b.example", 2)
+		if n := server.conns.Load(); n != 2 {
+			t.Errorf("%v: %v connections", tt.name, n)
+		}
+		pool.Close()
+	}
+}
+
+// срабатывание таймера простоя после регистрации запроса не закрывает соединение
+func TestPoolIdleTimerAfterRegister(t *testing.T) {
+	server := newPipeServer(t, 1, answerByName(t))
+	pool := NewTCPPool()
+	defer pool.Close()
+	c, err := pool.get(context.Background(), server.addr, Config{}.dialTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, ok := c.register(1)
+	if !ok {
+		t.Fatal("register failed")
+	}
+	c.closeIfIdle()
+	if err := c.closeErr(); err != nil {
+		t.Fatalf("closed with a pending query: %v", err)
+	}
+	c.unregister(id)
+	c.closeIfIdle()
+	if err := c.closeErr(); !errors.Is(err, errIdleTimeout) {
+		t.Errorf("idle connection: %v", err)
+	}
+	if _, _, ok := c.register(2); ok {
+		t.Error("register on a closed connection")
+	}
+}
+
+func TestPoolKeepaliveOption(t *testing.T) {
+	plain, err := makeQuery(RR_A, "a.example", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withOpt := appendOpt(plain, 4096, EdnsOption{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	withKeepalive := appendOpt(plain, 4096, EdnsOption{Code: EdnsTCPKeepalive})
+	tests := []struct {
+		name  string
+		query []byte
+		size  uint16
+		codes []uint16
+	}{
+		{"no OPT", plain, defaultEdnsUDPSize, []uint16{EdnsTCPKeepalive}},
+		{"OPT with cookie", withOpt, 4096, []uint16{10, EdnsTCPKeepalive}},
+		{"OPT with keepalive", withKeepalive, 4096, []uint16{EdnsTCPKeepalive}},
+	}
+	for _, tt := range tests {
+		server := newPipeServer(t, 1, answerByName(t))
+		pool := NewTCPPool()
+		if _, err := pool.Exchange(context.Background(), server.addr, tt.query); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		pool.Close()
+		msg, err := ParseMessage(<-server.queries)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if len(msg.Additional) != 1 || msg.Additional[0].Type != RR_OPT || uint16(msg.Additional[0].Class) != tt.size {
+			t.Errorf("%v: additional %+v", tt.name, msg.Additional)
+			continue
+		}
+		var codes []uint16
+		for _, option := range msg.Additional[0].Data.(DnsOpt).Options {
+			codes = append(codes, option.Code)
+		}
+		if !reflect.DeepEqual(codes, tt.codes) {
+			t.Errorf("%v: options %v, want %v", tt.name, codes, tt.codes)
+		}
+	}
+}
+
+func TestPoolResolve(t *testing.T) {
+	server := newPipeServer(t, 1, answerByName(t))
+	pool := NewTCPPool()
+	defer pool.Close()
+	config := Config{Server: server.addr, IsTCP: true, TCPPool: pool}
+	for i := 0; i < 3; i++ {
+		ips, err := ResolveA("a.example", config)
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("ResolveA = %v, %v", ips, err)
+		}
+	}
+	if n := server.conns.Load(); n != 1 {
+		t.Errorf("%v connections", n)
+	}
+}
@@ -0,0 +1,110 @@
+package awesomedns
+
+import (
+	"context"
+	"fmt"
+)
+
+// Transport доставляет запрос в формате сообщения и возвращает ответ на него.
+// через Config.Transport можно подставить свой транспорт, прокси, запись или заглушку
+type Transport interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// TransportFunc позволяет использовать функцию как Transport
+type TransportFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f TransportFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// Middleware оборачивает транспорт: может посмотреть и изменить запрос до отправки
+// и ответ после получения, ответить сам или не пропустить запрос. ответ все равно
+// сверяется с исходным запросом, поэтому изменивший имя в запросе должен вернуть его в ответе
+type Middleware func(next Transport) Transport
+
+// Chain оборачивает transport в middleware, первый в списке - внешний
+func Chain(transport Transport, middleware ...Middleware) Transport {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+	return transport
+}
+
+// NewServerTransport встроенный транспорт до server с учетом IsTCP, TCPPool, TLS и HTTPS из config.
+// удобно оборачивать своим транспортом
+func NewServerTransport(server string, config Config) Transport {
+	return serverTransport{server, config}
+}
+
+type serverTransport struct {
+	server string
+	config Config
+}
+
+// Exchange при обрезанном ответе по udp повторяет запрос по tcp
+func (t serverTransport) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	config := t.config
+	response, err := t.exchange(ctx, q, config)
+	if err != nil || !isTruncated(response) {
+		return response, err
+	}
+	config.Metrics.truncated(t.server)
+	if config.isTCP() {
+		return response, nil
+	}
+	config.Metrics.tcpFallback(t.server)
+	config.IsTCP = true
+	if parent, ok := ctx.Value(exchangeCtxKey{}).(context.Context); ok {
+		// у повтора свой таймаут tcp, время ожидания по udp не в счет
+		var cancel context.CancelFunc
+		ctx, cancel = config.exchangeContext(parent, true)
+		defer cancel()
+	}
+	return t.exchange(ctx, q, config)
+}
+
+func (t serverTransport) exchange(ctx context.Context, q []byte, config Config) ([]byte, error) {
+	switch {
+	case config.HTTPS != nil:
+		return exchangeRecorded(ctx, config.HTTPS.exchange, t.server, q, dnstapProtocolDOH, config)
+	case config.TLS != nil:
+		return exchangeRecorded(ctx, config.TLS.pool.exchanger(config.TLS.dial(config)), dotServer(t.server), q, dnstapProtocolDOT, config)
+	case config.IsTCP && config.TCPPool != nil:
+		return exchangeRecorded(ctx, config.TCPPool.exchanger(config.dialTCP), t.server, q, dnstapProtocolTCP, config)
+	default:
+		return exchangeDial(ctx, t.server, q, config.IsTCP, config)
+	}
+}
+
+type upstream struct {
+	name      string
+	transport Transport
+}
+
+// upstreams транспорты в порядке опроса, обернутые в Config.Middleware.
+// Config.Transport заменяет список серверов
+func (config Config) upstreams() []upstream {
+	if config.Transport != nil {
+		name := fmt.Sprintf("%T", config.Transport)
+		return []upstream{{name, config.wrapTransport(name, config.Transport)}}
+	}
+	var res []upstream
+	for _, server := range config.servers() {
+		res = append(res, upstream{server, config.wrapTransport(server, NewServerTransport(server, config))})
+	}
+	return res
+}
+
+// wrapTransport метрики измеряют обмен с сервером, middleware снаружи них
+func (config Config) wrapTransport(name string, transport Transport) Transport {
+	return Chain(config.Metrics.wrap(name, transport), config.Middleware...)
+}
+
+func isTruncated(response []byte) bool {
+	return len(response) >= headerLen && response[2]&0b10 != 0
+}
+
+func (config Config) isTCP() bool {
+	return config.IsTCP || config.TLS != nil || config.HTTPS != nil
+}
@@ -0,0 +1,208 @@
+package awesomedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeTransport отвечает записями answer на любой запрос и запоминает имена запросов.
+// записи без владельца принадлежат имени из запроса
+func fakeTransport(t *testing.T, rcode byte, answer ...testRR) (Transport, func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	transport := TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		msg, err := ParseMessage(q)
+		if err != nil {
+			return nil, err
+		}
+		qname := msg.Question[0].Name
+		mu.Lock()
+		queries = append(queries, qname)
+		mu.Unlock()
+		records := append([]testRR(nil), answer...)
+		for i := range records {
+			if records[i].name == "" {
+				records[i].name = qname
+			}
+		}
+		return testResponse(t, q, rcode, records, nil), nil
+	})
+	return transport, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+func TestTransportResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rrtype DnsType
+		answer []testRR
+		want   []interface{}
+	}{
+		{"A", RR_A, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, []interface{}{net.ParseIP("192.0.2.1").To4()}},
+		{"AAAA", RR_AAAA, []testRR{{"example.com", RR_AAAA, 60, "2001:db8::1"}}, []interface{}{net.ParseIP("2001:db8::1")}},
+		{"TXT", RR_TXT, []testRR{{"example.com", RR_TXT, 60, "v=spf1 -all"}}, []interface{}{"v=spf1 -all"}},
+		{"NS", RR_NS, []testRR{{"example.com", RR_NS, 60, "ns1.example.com"}, {"example.com", RR_NS, 60, "ns2.example.com"}},
+			[]interface{}{"ns1.example.com", "ns2.example.com"}},
+		{"no data", RR_A, nil, nil},
+	}
+	for _, tt := range tests {
+		transport, queries := fakeTransport(t, 0, tt.answer...)
+		res, _, err := Resolve(tt.rrtype, "example.com", Config{Transport: transport, Server: "192.0.2.53:53"})
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, tt.want) {
+			t.Errorf("%v: Resolve = %v, want %v", tt.name, res, tt.want)
+		}
+		// Transport заменяет список серверов
+		if q := queries(); len(q) != 1 || q[0] != "example.com" {
+			t.Errorf("%v: queries %v", tt.name, q)
+		}
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	errDown := errors.New("transport is down")
+	tests := []struct {
+		name      string
+		transport Transport
+		want      error
+	}{
+		{"transport error", TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			return nil, errDown
+		}), errDown},
+		{"NXDOMAIN", TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			return testResponse(t, q, 3, nil, nil), nil
+		}), errNameError},
+		{"SERVFAIL", TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			return testResponse(t, q, 2, nil, nil), nil
+		}), errServFail},
+		{"wrong id", TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			res := testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+			binary.BigEndian.PutUint16(res, binary.BigEndian.Uint16(q)+1)
+			return res, nil
+		}), errResponseMismatch},
+		{"query instead of response", TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+			return q, nil
+		}), errResponseMismatch},
+	}
+	for _, tt := range tests {
+		ips, err := ResolveA("example.com", Config{Transport: tt.transport})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%v: ResolveA = %v, %v, want %v", tt.name, ips, err, tt.want)
+		}
+	}
+}
+
+func TestTransportBulk(t *testing.T) {
+	names := []string{"a.example", "b.example", "c.example"}
+	tests := []struct {
+		name string
+		bulk func(req []string, config Config) (map[string]Answer, error)
+	}{
+		{"BulkResolveA", BulkResolveA},
+		{"MegaBulkResolveA", MegaBulkResolveA},
+	}
+	for _, tt := range tests {
+		transport, queries := fakeTransport(t, 0, testRR{"", RR_A, 60, "192.0.2.1"})
+		res, err := tt.bulk(names, Config{Transport: transport})
+		if err != nil || len(res) != len(names) {
+			t.Errorf("%v: %v, %v", tt.name, res, err)
+			continue
+		}
+		for _, name := range names {
+			if res[name].Err != nil || len(res[name].Ips) != 1 {
+				t.Errorf("%v: %v = %+v", tt.name, name, res[name])
+			}
+		}
+		if q := queries(); len(q) != len(names) {
+			t.Errorf("%v: queries %v", tt.name, q)
+		}
+	}
+}
+
+func TestServerTransport(t *testing.T) {
+	server := udpServer(t, func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	})
+	var wrapped int
+	config := Config{}
+	config.Transport = TransportFunc(func(ctx context.Context, q []byte) ([]byte, error) {
+		wrapped++
+		return NewServerTransport(server, config).Exchange(ctx, q)
+	})
+	ips, err := ResolveA("example.com", config)
+	if err != nil || len(ips) != 1 || wrapped != 1 {
+		t.Errorf("ResolveA = %v, %v, wrapped %v", ips, err, wrapped)
+	}
+}
+
+// MegaBulkResolveA отправляет запросы по tcp, DoT, DoH и с middleware через транспорт, а не через udp сокет
+func TestMegaBulkNonUDP(t *testing.T) {
+	answer := func(q []byte) []byte {
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	}
+	tcp := tcpServer(t, answer)
+	udp := udpServer(t, answer)
+	cert, x509Cert := selfSigned(t)
+	dotAddr, _ := fakeDoTServer(t, cert)
+	dot, err := NewDoT(DoTConfig{SPKIPins: []string{SPKIPin(x509Cert)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	dohServer, _ := fakeDoHServer(t, nil)
+	doh, err := NewDoH(DoHConfig{URL: dohServer.URL + "/dns-query{?dns}", Client: dohServer.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		config   Config
+		protocol int
+		want     string
+	}{
+		{"tcp", Config{Server: tcp, IsTCP: true}, dnstapProtocolTCP, "192.0.2.1"},
+		{"DoT", Config{Server: dotAddr, TLS: dot}, dnstapProtocolDOT, "192.0.2.53"},
+		{"DoH without Server", Config{HTTPS: doh}, dnstapProtocolDOH, "192.0.2.80"},
+		// с middleware udp тоже идет через транспорт, и dnstap пишет только он
+		{"udp with middleware", Config{Server: udp, Middleware: []Middleware{func(next Transport) Transport { return next }}}, dnstapProtocolUDP, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		dw, err := NewDnstapWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.config.Dnstap = dw
+		res, err := MegaBulkResolveA([]string{"example.com"}, tt.config)
+		if err != nil || res["example.com"].Err != nil || len(res["example.com"].Ips) != 1 || res["example.com"].Ips[0].String() != tt.want {
+			t.Errorf("%v: %+v, %v", tt.name, res, err)
+			continue
+		}
+		// запрос и ответ записаны по разу и с протоколом транспорта
+		readFstrmFrame(&buf)
+		for _, typ := range []int{dnstapToolQuery, dnstapToolResponse} {
+			frame, err := readFstrmFrame(&buf)
+			if err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			if m := dnstapMessage(t, frame); m[1] != uint64(typ) || m[3] != uint64(tt.protocol) {
+				t.Errorf("%v: %v", tt.name, m)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%v: %v more bytes of dnstap", tt.name, buf.Len())
+		}
+	}
+}
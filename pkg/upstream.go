@@ -0,0 +1,43 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+var errNoServers = errors.New("no servers configured")
+
+func (config Config) servers() []string {
+	var res []string
+	if config.Server != "" {
+		res = append(res, config.Server)
+	}
+	res = append(res, config.Servers...)
+	if len(res) == 0 && config.HTTPS != nil {
+		res = append(res, config.HTTPS.url)
+	}
+	return res
+}
+
+// firstServer номер сервера, с которого начинается запрос
+func (config Config) firstServer(servers int) int {
+	if !config.Rotate || config.rotation == nil {
+		return 0
+	}
+	return int((config.rotation.Add(1) - 1) % uint32(servers))
+}
+
+// isRetryable true если ошибка относится к конкретному серверу и стоит спросить другой
+func isRetryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, errServFail) ||
+		errors.Is(err, errRefused) ||
+		errors.Is(err, errNotImplemented) ||
+		errors.Is(err, errResponseMismatch) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
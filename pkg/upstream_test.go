@@ -0,0 +1,119 @@
+package awesomedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer udp заглушка, отвечающая кодом rcode (адрес 192.0.2.1 при успехе),
+// или молчащая при rcode < 0. считает запросы
+func countingServer(t *testing.T, rcode int) (string, *atomic.Int32) {
+	t.Helper()
+	var count atomic.Int32
+	server := udpServer(t, func(q []byte) []byte {
+		count.Add(1)
+		switch {
+		case rcode < 0:
+			return nil
+		case rcode > 0:
+			return testResponse(t, q, byte(rcode), nil, nil)
+		}
+		return testResponse(t, q, 0, []testRR{{"example.com", RR_A, 60, "192.0.2.1"}}, nil)
+	})
+	return server, &count
+}
+
+func TestFailover(t *testing.T) {
+	const silent = -1
+	tests := []struct {
+		name     string
+		rcodes   []int // ответ каждого сервера по порядку
+		attempts int
+		err      error
+		want     []int32 // число запросов к каждому серверу
+	}{
+		{"servfail", []int{2, 0}, 0, nil, []int32{1, 1}},
+		{"refused", []int{5, 0}, 0, nil, []int32{1, 1}},
+		{"not implemented", []int{4, 0}, 0, nil, []int32{1, 1}},
+		{"timeout", []int{silent, 0}, 0, nil, []int32{1, 1}},
+		{"timeout and servfail", []int{silent, 2, 0}, 0, nil, []int32{1, 1, 1}},
+		{"nxdomain is an answer", []int{3, 0}, 0, errNameError, []int32{1, 0}},
+		{"all fail", []int{2, 5}, 0, errRefused, []int32{1, 1}},
+		{"attempts", []int{2, silent}, 3, context.DeadlineExceeded, []int32{3, 3}},
+		{"attempts stop on success", []int{2, 0}, 3, nil, []int32{1, 1}},
+	}
+	for _, tt := range tests {
+		var servers []string
+		var counts []*atomic.Int32
+		for _, rcode := range tt.rcodes {
+			server, count := countingServer(t, rcode)
+			servers = append(servers, server)
+			counts = append(counts, count)
+		}
+		config := Config{Server: servers[0], Servers: servers[1:], Attempts: tt.attempts, UDPTimeout: 100 * time.Millisecond}
+		_, err := ResolveA("example.com", config)
+		if !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.err)
+		}
+		var got []int32
+		for _, count := range counts {
+			got = append(got, count.Load())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: queries %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoServers(t *testing.T) {
+	if _, err := ResolveA("example.com", Config{}); !errors.Is(err, errNoServers) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate bool
+		shared bool // все запросы через один Resolver
+		want   []int32
+	}{
+		{"rotate", true, true, []int32{2, 2, 2}},
+		{"no rotate", false, true, []int32{6, 0, 0}},
+		// у каждого вызова функции пакета свой Resolver и своя очередь
+		{"rotate with package functions", true, false, []int32{6, 0, 0}},
+	}
+	for _, tt := range tests {
+		var servers []string
+		var counts []*atomic.Int32
+		for i := 0; i < 3; i++ {
+			server, count := countingServer(t, 0)
+			servers = append(servers, server)
+			counts = append(counts, count)
+		}
+		config := Config{Servers: servers, Rotate: tt.rotate}
+		r := NewResolver(config)
+		for i := 0; i < 6; i++ {
+			var err error
+			if tt.shared {
+				_, err = r.ResolveA(context.Background(), "example.com")
+			} else {
+				_, err = ResolveA("example.com", config)
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+		}
+		var got []int32
+		for _, count := range counts {
+			got = append(got, count.Load())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: queries %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}